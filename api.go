@@ -0,0 +1,229 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+const (
+	// Path under which the JSON API is served
+	apiPrefix = "/api/v1/"
+	// Path of the API collection of pastes, relative to apiPrefix
+	apiPastes = "pastes"
+	// Number of pastes listed at once by default, and at most
+	listLimit    = 100
+	maxListLimit = 1000
+
+	unknownEndpoint  = "unknown api endpoint"
+	listForbidden    = "listing pastes is not allowed"
+	listUnsupported  = "store does not support listing pastes"
+	invalidListLimit = "invalid limit"
+)
+
+// pasteInfo is the JSON representation of a paste in the API
+type pasteInfo struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// URL serving the content as is, which tools should fetch it from
+	// even if it is the same as URL for now
+	RawURL string `json:"raw_url"`
+	Size   int64  `json:"size"`
+	// Name of the file the paste was uploaded as, if any
+	Filename string `json:"filename,omitempty"`
+	// Content type declared by the uploader, if any
+	ContentType string            `json:"content_type,omitempty"`
+	Header      map[string]string `json:"header,omitempty"`
+	Views       int64             `json:"views"`
+
+	Created time.Time `json:"created"`
+	// Null if the paste never expires
+	Expires *time.Time `json:"expires"`
+	Burn    bool       `json:"burn"`
+	// Whether the content was encrypted by the uploader
+	Encrypted bool `json:"encrypted"`
+	// Whether reading the paste requires a password
+	Password bool `json:"password"`
+
+	// Only given when the paste is uploaded
+	DeleteToken string `json:"delete_token,omitempty"`
+}
+
+// pasteList is a page of the list of pastes in the API
+type pasteList struct {
+	Pastes []pasteInfo `json:"pastes"`
+	// ID to list the following pastes after, if there are any
+	Next string `json:"next,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func newPasteInfo(r *http.Request, id storage.ID, size int64, created time.Time, meta storage.Metadata) pasteInfo {
+	info := pasteInfo{
+		ID:          id.String(),
+		URL:         pasteURL(r, id),
+		RawURL:      pasteURL(r, id),
+		Size:        size,
+		Filename:    meta.Filename,
+		ContentType: meta.ContentType,
+		Header:      meta.Header,
+		Views:       meta.Views,
+		Created:     created.UTC(),
+		Burn:        meta.Burn,
+		Encrypted:   meta.Encrypted,
+		Password:    meta.PasswordHash != "",
+	}
+	if !meta.Expires.IsZero() {
+		expires := meta.Expires.UTC()
+		info.Expires = &expires
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON reply: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// serveAPI serves the JSON API given the request path relative to
+// apiPrefix:
+//
+//	POST   pastes       upload a new paste
+//	GET    pastes       list the pastes, if allowed
+//	GET    pastes/{id}  get the information about a paste
+//	DELETE pastes/{id}  delete a paste given its delete token
+func (h *httpHandler) serveAPI(w http.ResponseWriter, r *http.Request, path string) {
+	if path == apiPastes {
+		switch r.Method {
+		case "POST":
+			p, status, err := h.putPaste(w, r)
+			if err != nil {
+				writeJSONError(w, status, err)
+				return
+			}
+			info := newPasteInfo(r, p.id, p.size, p.created, p.meta)
+			info.DeleteToken = p.token
+			w.Header().Set("Location", apiPrefix+apiPastes+"/"+info.ID)
+			writeJSON(w, http.StatusCreated, info)
+		case "GET":
+			list, status, err := h.listPastes(r)
+			if err != nil {
+				writeJSONError(w, status, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, list)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, errors.New(unknownAction))
+		}
+		return
+	}
+	rawID := strings.TrimPrefix(path, apiPastes+"/")
+	if rawID == path {
+		writeJSONError(w, http.StatusNotFound, errors.New(unknownEndpoint))
+		return
+	}
+	switch r.Method {
+	case "GET":
+		id, paste, status, err := h.getPaste(rawID)
+		if err != nil {
+			writeJSONError(w, status, err)
+			return
+		}
+		if status, err := checkPassword(w, r, paste.Metadata()); err != nil {
+			paste.Close()
+			writeJSONError(w, status, err)
+			return
+		}
+		info := newPasteInfo(r, id, paste.Size(), paste.ModTime(), paste.Metadata())
+		info.Views += h.views.get(id)
+		paste.Close()
+		writeJSON(w, http.StatusOK, info)
+	case "DELETE":
+		if _, status, err := h.deletePaste(r, rawID); err != nil {
+			writeJSONError(w, status, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New(unknownAction))
+	}
+}
+
+// listPastes returns a page of the list of pastes sorted by ID, starting
+// after the one given via the query, if any. Only the clients given via -A
+// may list them, as IDs are what keeps pastes private.
+func (h *httpHandler) listPastes(r *http.Request) (*pasteList, int, error) {
+	ip := net.ParseIP(clientAddr(r))
+	if ip == nil || !conf().listClients.contains(ip) {
+		return nil, http.StatusForbidden, errors.New(listForbidden)
+	}
+	lister, ok := h.store.(storage.Lister)
+	if !ok {
+		return nil, http.StatusNotImplemented, errors.New(listUnsupported)
+	}
+	query := r.URL.Query()
+	limit := listLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, http.StatusBadRequest, errors.New(invalidListLimit)
+		}
+		if limit = n; limit > maxListLimit {
+			limit = maxListLimit
+		}
+	}
+	ids, err := lister.List()
+	if err != nil {
+		log.Printf("Unknown error on list: %v", err)
+		h.metrics.storeError("list")
+		return nil, http.StatusInternalServerError, err
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	after := storage.ID(query.Get("after"))
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] > after })
+	list := &pasteList{Pastes: []pasteInfo{}}
+	for ; i < len(ids) && len(list.Pastes) < limit; i++ {
+		paste, err := h.store.Get(ids[i])
+		if err == storage.ErrPasteNotFound {
+			// deleted in the meantime
+			continue
+		}
+		if err != nil {
+			log.Printf("Unknown error on list: %v", err)
+			h.metrics.storeError("get")
+			return nil, http.StatusInternalServerError, err
+		}
+		if paste.Metadata().Expired(time.Now()) {
+			paste.Close()
+			continue
+		}
+		info := newPasteInfo(r, ids[i], paste.Size(), paste.ModTime(), paste.Metadata())
+		info.Views += h.views.get(ids[i])
+		paste.Close()
+		list.Pastes = append(list.Pastes, info)
+	}
+	if i < len(ids) {
+		list.Next = ids[i-1].String()
+	}
+	return list, http.StatusOK, nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const apiPastesPath = apiPrefix + apiPastes
+
+// decodeJSON decodes the JSON body of a response into v.
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if got := w.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+		t.Errorf("Got Content-Type %q, want JSON", got)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("Could not decode JSON reply %q: %v", w.Body, err)
+	}
+}
+
+// wantAPIError checks that a response is a JSON error with the given status.
+func wantAPIError(t *testing.T, w *httptest.ResponseRecorder, what string, status int) {
+	t.Helper()
+	wantResponse(t, w, what, status, "")
+	var e apiError
+	decodeJSON(t, w, &e)
+	if e.Error == "" {
+		t.Errorf("%s did not give an error message", what)
+	}
+}
+
+func TestAPIPaste(t *testing.T) {
+	h := newTestHandler(t)
+	before := time.Now()
+	w := upload(h, apiPastesPath, "foo", expireName, "1h")
+	wantResponse(t, w, "POST", http.StatusCreated, "")
+	var info pasteInfo
+	decodeJSON(t, w, &info)
+	if info.ID == "" || info.DeleteToken == "" {
+		t.Fatalf("POST got no ID or delete token: %s", w.Body)
+	}
+	if want := apiPastesPath + "/" + info.ID; w.Header().Get("Location") != want {
+		t.Errorf("POST got Location %q, want %q", w.Header().Get("Location"), want)
+	}
+	if want := "http://localhost:8080/" + info.ID; info.URL != want || info.RawURL != want {
+		t.Errorf("POST got URL %q and raw URL %q, want %q", info.URL, info.RawURL, want)
+	}
+	if info.Size != 3 {
+		t.Errorf("POST got size %d, want 3", info.Size)
+	}
+	if info.Expires == nil || info.Expires.Before(before.Add(time.Hour)) ||
+		info.Expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("POST got expiry %v, want in an hour", info.Expires)
+	}
+	id, token := info.ID, info.DeleteToken
+
+	rawPath := strings.TrimPrefix(info.RawURL, "http://localhost:8080")
+	wantResponse(t, serve(h, "GET", rawPath, nil), "GET of the raw URL", http.StatusOK, "foo")
+	w = serve(h, "GET", apiPastesPath+"/"+id, nil)
+	wantResponse(t, w, "GET", http.StatusOK, "")
+	info = pasteInfo{}
+	decodeJSON(t, w, &info)
+	if info.ID != id || info.RawURL == "" || info.Size != 3 || info.DeleteToken != "" {
+		t.Errorf("GET got unexpected information: %s", w.Body)
+	}
+	if info.Views != 1 {
+		t.Errorf("GET got %d views, want 1", info.Views)
+	}
+
+	wantAPIError(t, serve(h, "GET", apiPastesPath+"/"+id+"0", nil), "GET of a missing paste", http.StatusNotFound)
+	wantAPIError(t, serve(h, "GET", apiPastesPath+"/-invalid-", nil), "GET of an invalid ID", http.StatusBadRequest)
+	wantAPIError(t, serve(h, "DELETE", apiPastesPath+"/"+id, nil), "DELETE without token", http.StatusForbidden)
+	wantAPIError(t, serve(h, "PUT", apiPastesPath+"/"+id, nil), "PUT", http.StatusMethodNotAllowed)
+
+	w = serve(h, "DELETE", apiPastesPath+"/"+id, http.Header{"Delete-Token": {token}})
+	wantResponse(t, w, "DELETE with the token", http.StatusNoContent, "")
+	wantAPIError(t, serve(h, "GET", apiPastesPath+"/"+id, nil), "GET after deleting", http.StatusNotFound)
+	wantAPIError(t, serve(h, "DELETE", apiPastesPath+"/"+id, http.Header{"Delete-Token": {token}}),
+		"Second DELETE", http.StatusNotFound)
+}
+
+func TestAPIErrors(t *testing.T) {
+	h := newTestHandler(t)
+	wantAPIError(t, upload(h, apiPastesPath, "", expireName, "1h"), "POST without content", http.StatusBadRequest)
+	wantAPIError(t, upload(h, apiPastesPath, "foo", expireName, "soon"), "POST with an invalid expiry", http.StatusBadRequest)
+	wantAPIError(t, serve(h, "PUT", apiPastesPath, nil), "PUT", http.StatusMethodNotAllowed)
+	wantAPIError(t, serve(h, "GET", apiPrefix+"other", nil), "GET of an unknown endpoint", http.StatusNotFound)
+}
+
+func TestAPIPassword(t *testing.T) {
+	h := newTestHandler(t)
+	id, _ := mustUpload(t, h, "foo", passwordName, "secret")
+	w := serve(h, "GET", apiPastesPath+"/"+id, nil)
+	wantAPIError(t, w, "GET without password", http.StatusUnauthorized)
+	wantAPIError(t, serve(h, "GET", apiPastesPath+"/"+id+"?password=wrong", nil),
+		"GET with a wrong password", http.StatusUnauthorized)
+	w = serve(h, "GET", apiPastesPath+"/"+id+"?password=secret", nil)
+	wantResponse(t, w, "GET with the password", http.StatusOK, "")
+	var info pasteInfo
+	decodeJSON(t, w, &info)
+	if !info.Password {
+		t.Errorf("GET with the password is not marked as requiring it: %s", w.Body)
+	}
+}
+
+func TestAPIList(t *testing.T) {
+	h := newTestHandler(t)
+	wantAPIError(t, serve(h, "GET", apiPastesPath, nil), "GET without -A", http.StatusForbidden)
+	h = newTestHandler(t, "-A", "203.0.113.0/24", "-P", "192.0.2.1")
+	wantAPIError(t, serve(h, "GET", apiPastesPath, http.Header{"Forwarded": {"for=203.0.113.5"}}),
+		"GET with a spoofed Forwarded header", http.StatusForbidden)
+
+	// requests made by httptest come from 192.0.2.1
+	h = newTestHandler(t, "-A", "192.0.2.0/24")
+	var ids []string
+	for _, content := range []string{"foo", "bar", "baz"} {
+		id, _ := mustUpload(t, h, content)
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var got []string
+	after := ""
+	for pages := 0; pages < len(ids); pages++ {
+		w := serve(h, "GET", apiPastesPath+"?limit=2&after="+after, nil)
+		wantResponse(t, w, "GET of the list", http.StatusOK, "")
+		var list pasteList
+		decodeJSON(t, w, &list)
+		for _, info := range list.Pastes {
+			got = append(got, info.ID)
+		}
+		if after = list.Next; after == "" {
+			break
+		}
+	}
+	if len(got) != len(ids) {
+		t.Fatalf("Listing got %q, want %q", got, ids)
+	}
+	for i := range ids {
+		if got[i] != ids[i] {
+			t.Fatalf("Listing got %q, want %q", got, ids)
+		}
+	}
+	wantAPIError(t, serve(h, "GET", apiPastesPath+"?limit=0", nil), "GET with a zero limit", http.StatusBadRequest)
+	wantAPIError(t, serve(h, "GET", apiPastesPath+"?limit=x", nil), "GET with an invalid limit", http.StatusBadRequest)
+}
@@ -0,0 +1,438 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+const (
+	// Prefix of the environment variables holding settings
+	envPrefix = "PASTECAT_"
+	// Environment variable holding the configuration file to read, if
+	// not given via a flag
+	envConfig = envPrefix + "CONFIG"
+	// Table of the configuration file holding the storage settings, which
+	// is also the prefix of their keys
+	storageTable = "storage"
+	// Key of the storage type, within storageTable
+	storageTypeKey = "type"
+)
+
+// Configuration in use, swapped when reloading it
+var current atomic.Pointer[config]
+
+// conf returns the configuration in use. Its fields must not be modified.
+func conf() *config {
+	return current.Load()
+}
+
+// config holds the settings that pastecat runs with
+type config struct {
+	siteURL      string
+	listen       string
+	templatesDir string
+	lifeTime     time.Duration
+	timeout      time.Duration
+	maxNumber    int
+	maxSize      storage.ByteSize
+	maxStorage   storage.ByteSize
+	evictPolicy  storage.EvictPolicy
+	dedup        bool
+	compress     bool
+	encryptKeys  string
+	idFormat     storage.IDFormat
+
+	uploadRate     float64
+	uploadBurst    int
+	uploadQuota    storage.ByteSize
+	quotaWindow    time.Duration
+	clientPrefix   prefixLengths
+	exemptClients  netList
+	trustedProxies netList
+	proxyHeader    string
+	listClients    netList
+
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	redirectFrom string
+
+	storageType   string
+	storageParams map[string]string
+
+	// configuration file to read, if any
+	file string
+	// whether to print the configuration and exit
+	print bool
+
+	flags *flag.FlagSet
+}
+
+// configKeys maps the keys of the configuration file to the flags they
+// correspond to. Their environment variables are the keys in upper case,
+// prefixed with envPrefix.
+var configKeys = [...]struct{ key, flag string }{
+	{"site_url", "u"},
+	{"listen", "l"},
+	{"templates", "H"},
+	{"lifetime", "t"},
+	{"timeout", "T"},
+	{"max_number", "m"},
+	{"max_size", "s"},
+	{"max_storage", "M"},
+	{"evict", "e"},
+	{"dedup", "D"},
+	{"compress", "z"},
+	{"encryption_keys", "K"},
+	{"id_format", "i"},
+	{"upload_rate", "r"},
+	{"upload_burst", "b"},
+	{"upload_quota", "q"},
+	{"quota_window", "w"},
+	{"client_prefix", "p"},
+	{"exempt", "x"},
+	{"trusted_proxies", "P"},
+	{"proxy_header", "F"},
+	{"list_clients", "A"},
+	{"tls_cert", "c"},
+	{"tls_key", "k"},
+	{"tls_client_ca", "C"},
+	{"redirect_from", "L"},
+}
+
+// storageParam is a parameter of a storage type along with its default
+// value
+type storageParam struct {
+	name, def string
+}
+
+// storageTypes holds the parameters of each storage type, in the order in
+// which they can be given as arguments
+var storageTypes = map[string][]storageParam{
+	"fs":      {{"dir", "pastes"}},
+	"fs-mmap": {{"dir", "pastes"}},
+	"mem":     nil,
+}
+
+func newConfig() *config {
+	c := &config{
+		maxSize:       1 * storage.MB,
+		maxStorage:    1 * storage.GB,
+		evictPolicy:   storage.EvictNone,
+		idFormat:      storage.DefaultIDFormat,
+		clientPrefix:  prefixLengths{v4: 32, v6: 128},
+		storageType:   "fs",
+		storageParams: make(map[string]string),
+	}
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&c.file, "f", "", "Configuration file to read")
+	fs.BoolVar(&c.print, "d", false, "Print the configuration and exit")
+	fs.StringVar(&c.siteURL, "u", "http://localhost:8080", "URL of the site")
+	fs.StringVar(&c.listen, "l", ":8080", "Host and port to listen to")
+	fs.StringVar(&c.templatesDir, "H", "", "Directory of templates replacing the builtin ones")
+	fs.DurationVar(&c.lifeTime, "t", 24*time.Hour, "Maximum lifetime of the pastes")
+	fs.DurationVar(&c.timeout, "T", 5*time.Second, "Timeout of HTTP requests")
+	fs.IntVar(&c.maxNumber, "m", 0, "Maximum number of pastes to store at once")
+	fs.Var(&c.maxSize, "s", "Maximum size of pastes")
+	fs.Var(&c.maxStorage, "M", "Maximum storage size to use at once")
+	fs.Var(&c.evictPolicy, "e", "Pastes to delete when reaching -m or -M (none, oldest, least-read)")
+	fs.BoolVar(&c.dedup, "D", false, "Keep a single copy of pastes with the same content")
+	fs.BoolVar(&c.compress, "z", false, "Keep pastes compressed with gzip")
+	fs.StringVar(&c.encryptKeys, "K", "", "File of the keys to keep pastes encrypted with")
+	fs.Var(&c.idFormat, "i", "Format of the IDs of new pastes (hex, base62, base32, words), with an optional :length")
+
+	fs.Float64Var(&c.uploadRate, "r", 0, "Uploads allowed per minute per client")
+	fs.IntVar(&c.uploadBurst, "b", 10, "Uploads allowed at once per client")
+	fs.Var(&c.uploadQuota, "q", "Maximum size of the uploads per client within -w")
+	fs.DurationVar(&c.quotaWindow, "w", 24*time.Hour, "Window of the upload quota per client")
+	fs.Var(&c.clientPrefix, "p", "Lengths of the IPv4 and IPv6 prefixes to group clients by")
+	fs.Var(&c.exemptClients, "x", "Comma-separated networks exempt from -r and -q")
+	fs.Var(&c.trustedProxies, "P", "Comma-separated networks of trusted reverse proxies")
+	fs.StringVar(&c.proxyHeader, "F", headerXForwarded, "Headers that the trusted proxies set (x-forwarded, forwarded)")
+	fs.Var(&c.listClients, "A", "Comma-separated networks allowed to list the pastes via the API")
+
+	fs.StringVar(&c.certFile, "c", "", "TLS certificate file to serve HTTPS with")
+	fs.StringVar(&c.keyFile, "k", "", "TLS key file to serve HTTPS with")
+	fs.StringVar(&c.clientCAFile, "C", "", "CA file to verify the client certificates required to upload")
+	fs.StringVar(&c.redirectFrom, "L", "", "Host and port to redirect HTTP to HTTPS from")
+	c.flags = fs
+	return c
+}
+
+// loadConfig returns the configuration given by the command line
+// arguments, the environment and the configuration file, in order of
+// precedence. Errors point at the setting that caused them.
+func loadConfig(args, environ []string) (*config, error) {
+	c := newConfig()
+	if err := c.flags.Parse(args); err != nil {
+		return nil, err
+	}
+	fromArgs := make(map[string]bool)
+	c.flags.Visit(func(f *flag.Flag) { fromArgs[f.Name] = true })
+	set := func(where, key, value string) error {
+		if err := c.set(key, value, fromArgs); err != nil {
+			return fmt.Errorf("%s: %s: %v", where, key, err)
+		}
+		return nil
+	}
+
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 && strings.HasPrefix(kv, envPrefix) {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	if c.file == "" {
+		c.file = env[envConfig]
+	}
+	delete(env, envConfig)
+	if c.file != "" {
+		if err := readConfigFile(c.file, set); err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := env[name]
+		key := strings.ToLower(strings.TrimPrefix(name, envPrefix))
+		if strings.HasPrefix(key, storageTable+"_") {
+			key = storageTable + "." + key[len(storageTable)+1:]
+		}
+		if err := set(name, key, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.setStorageArgs(c.flags.Args()); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// set sets the setting known by key to value, unless it was given as a
+// flag.
+func (c *config) set(key, value string, fromArgs map[string]bool) error {
+	if strings.HasPrefix(key, storageTable+".") {
+		name := key[len(storageTable)+1:]
+		if name == storageTypeKey {
+			c.storageType = value
+		} else {
+			c.storageParams[name] = value
+		}
+		return nil
+	}
+	for _, ck := range configKeys {
+		if ck.key != key {
+			continue
+		}
+		if fromArgs[ck.flag] {
+			return nil
+		}
+		return c.flags.Set(ck.flag, value)
+	}
+	return errors.New("unknown setting")
+}
+
+// liveKeys are the settings that can change while running
+var liveKeys = map[string]bool{
+	"site_url":        true,
+	"templates":       true,
+	"lifetime":        true,
+	"max_number":      true,
+	"max_size":        true,
+	"max_storage":     true,
+	"id_format":       true,
+	"trusted_proxies": true,
+	"proxy_header":    true,
+	"list_clients":    true,
+}
+
+// reloadConfig loads the configuration again like loadConfig. The settings
+// that cannot change while running keep their values from old, and the
+// ones that were changed anyway are returned.
+func reloadConfig(old *config, args, environ []string) (*config, []string, error) {
+	c, err := loadConfig(args, environ)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fixed []string
+	for _, ck := range configKeys {
+		if liveKeys[ck.key] {
+			continue
+		}
+		oldValue := old.flags.Lookup(ck.flag).Value.String()
+		if c.flags.Lookup(ck.flag).Value.String() != oldValue {
+			c.flags.Set(ck.flag, oldValue)
+			fixed = append(fixed, ck.key)
+		}
+	}
+	if c.storageType != old.storageType {
+		fixed = append(fixed, storageTable+"."+storageTypeKey)
+	} else {
+		for _, param := range storageTypes[c.storageType] {
+			if c.storageParams[param.name] != old.storageParams[param.name] {
+				fixed = append(fixed, storageTable+"."+param.name)
+			}
+		}
+	}
+	c.storageType, c.storageParams = old.storageType, old.storageParams
+	return c, fixed, nil
+}
+
+// setStorageArgs sets the storage type and its parameters from the
+// arguments left after the flags. Parameters may be given in order or as
+// name=value.
+func (c *config) setStorageArgs(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	c.storageType = args[0]
+	c.storageParams = make(map[string]string)
+	params, e := storageTypes[c.storageType]
+	if !e {
+		return nil
+	}
+	for i, arg := range args[1:] {
+		if j := strings.Index(arg, "="); j >= 0 {
+			c.storageParams[arg[:j]] = arg[j+1:]
+		} else if i < len(params) {
+			c.storageParams[params[i].name] = arg
+		} else {
+			return fmt.Errorf("too many arguments given for %s", c.storageType)
+		}
+	}
+	return nil
+}
+
+// validate checks that the settings make sense together, filling in the
+// default storage parameters.
+func (c *config) validate() error {
+	if c.maxStorage > 1*storage.EB {
+		return errors.New("max_storage: would overflow int64")
+	}
+	if c.maxSize > 1*storage.EB {
+		return errors.New("max_size: would overflow int64")
+	}
+	if c.uploadQuota > 1*storage.EB {
+		return errors.New("upload_quota: would overflow int64")
+	}
+	if c.uploadQuota > 0 && c.quotaWindow < minQuotaWindow {
+		return fmt.Errorf("quota_window: must be at least %s", minQuotaWindow)
+	}
+	if c.proxyHeader != headerXForwarded && c.proxyHeader != headerForwarded {
+		return fmt.Errorf("proxy_header: must be %s or %s", headerXForwarded, headerForwarded)
+	}
+	if (c.certFile == "") != (c.keyFile == "") {
+		return errors.New("tls_cert, tls_key: must be given together")
+	}
+	if c.certFile == "" && c.clientCAFile != "" {
+		return errors.New("tls_client_ca: requires tls_cert and tls_key")
+	}
+	if c.certFile == "" && c.redirectFrom != "" {
+		return errors.New("redirect_from: requires tls_cert and tls_key")
+	}
+	params, e := storageTypes[c.storageType]
+	if !e {
+		return fmt.Errorf("%s.%s: unknown storage type '%s'", storageTable, storageTypeKey, c.storageType)
+	}
+	for name := range c.storageParams {
+		known := false
+		for _, param := range params {
+			known = known || param.name == name
+		}
+		if !known {
+			return fmt.Errorf("%s.%s: unknown parameter for storage type %s", storageTable, name, c.storageType)
+		}
+	}
+	for _, param := range params {
+		if _, e := c.storageParams[param.name]; !e {
+			c.storageParams[param.name] = param.def
+		}
+	}
+	return nil
+}
+
+// readConfigFile reads the settings in the configuration file at path,
+// calling set for each of them. The format is a subset of TOML: key =
+// value pairs with optionally quoted values, comments starting with '#',
+// and a [storage] table for the storage settings.
+func readConfigFile(path string, set func(where, key, value string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	table := ""
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		where := fmt.Sprintf("%s:%d", path, n)
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", line[0] == '#':
+			continue
+		case line[0] == '[':
+			name := strings.TrimSpace(strings.Trim(line, "[]"))
+			if name != storageTable {
+				return fmt.Errorf("%s: unknown table '%s'", where, name)
+			}
+			table = name
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return fmt.Errorf("%s: expected key = value", where)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return fmt.Errorf("%s: %s: invalid quoted value", where, key)
+			}
+		} else if j := strings.Index(value, "#"); j >= 0 {
+			value = strings.TrimSpace(value[:j])
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		if err := set(where, key, value); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// lines returns the configuration in the format of the configuration
+// file, one setting per line.
+func (c *config) lines() []string {
+	var lines []string
+	for _, ck := range configKeys {
+		value := c.flags.Lookup(ck.flag).Value.String()
+		lines = append(lines, fmt.Sprintf("%s = %s", ck.key, strconv.Quote(value)))
+	}
+	lines = append(lines, "", "["+storageTable+"]",
+		fmt.Sprintf("%s = %s", storageTypeKey, strconv.Quote(c.storageType)))
+	for _, param := range storageTypes[c.storageType] {
+		value := c.storageParams[param.name]
+		lines = append(lines, fmt.Sprintf("%s = %s", param.name, strconv.Quote(value)))
+	}
+	return lines
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a configuration file with the given content,
+// returning its path.
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "pastecat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "pastecat.conf")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `# comment
+listen = ":1"
+lifetime = 1h
+max_number = 5 # trailing comment
+site_url = "http://file.site"
+
+[storage]
+type = fs
+dir = "/from/file"
+`)
+	environ := []string{
+		"PASTECAT_CONFIG=" + path,
+		"PASTECAT_LISTEN=:2",
+		"PASTECAT_MAX_NUMBER=6",
+		"PASTECAT_STORAGE_DIR=/from/env",
+		"OTHER_VARIABLE=ignored",
+	}
+	c, err := loadConfig([]string{"-l", ":3"}, environ)
+	if err != nil {
+		t.Fatalf("loadConfig errored unexpectedly: %v", err)
+	}
+	if c.listen != ":3" {
+		t.Errorf("listen got %q, want the flag over the rest", c.listen)
+	}
+	if c.maxNumber != 6 {
+		t.Errorf("max_number got %d, want the environment over the file", c.maxNumber)
+	}
+	if c.lifeTime != time.Hour || c.siteURL != "http://file.site" {
+		t.Errorf("lifetime and site_url got %s and %q, want the file", c.lifeTime, c.siteURL)
+	}
+	if c.timeout != 5*time.Second {
+		t.Errorf("timeout got %s, want the default", c.timeout)
+	}
+	if c.storageType != "fs" || c.storageParams["dir"] != "/from/env" {
+		t.Errorf("storage got %s %v, want fs in the environment's dir", c.storageType, c.storageParams)
+	}
+
+	c, err = loadConfig([]string{"-f", path, "mem"}, nil)
+	if err != nil {
+		t.Fatalf("loadConfig errored unexpectedly: %v", err)
+	}
+	if c.listen != ":1" || c.storageType != "mem" {
+		t.Errorf("-f and arguments got %q and %s, want the file and the arguments", c.listen, c.storageType)
+	}
+	if len(c.storageParams) != 0 {
+		t.Errorf("storage arguments kept the parameters %v from the file", c.storageParams)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		args    []string
+		environ []string
+		file    string
+		wantErr string
+	}{
+		{environ: []string{"PASTECAT_FOO=1"}, wantErr: "PASTECAT_FOO: foo: unknown setting"},
+		{environ: []string{"PASTECAT_LIFETIME=abc"}, wantErr: "PASTECAT_LIFETIME: lifetime:"},
+		{environ: []string{"PASTECAT_STORAGE_TYPE=foo"}, wantErr: "storage.type: unknown storage type 'foo'"},
+		{environ: []string{"PASTECAT_STORAGE_FOO=1"}, wantErr: "storage.foo: unknown parameter"},
+		{environ: []string{"PASTECAT_CONFIG=/does/not/exist"}, wantErr: "/does/not/exist"},
+		{file: "foo = 1", wantErr: ":1: foo: unknown setting"},
+		{file: "\n[other]", wantErr: ":2: unknown table 'other'"},
+		{file: "listen", wantErr: ":1: expected key = value"},
+		{file: `listen = "foo`, wantErr: ":1: listen: invalid quoted value"},
+		{file: "max_size = 1Q", wantErr: ":1: max_size:"},
+		{args: []string{"mem", "foo"}, wantErr: "too many arguments given for mem"},
+		{args: []string{"-F", "via"}, wantErr: "proxy_header: must be x-forwarded or forwarded"},
+		{args: []string{"-c", "cert.pem"}, wantErr: "tls_cert, tls_key: must be given together"},
+	} {
+		environ := c.environ
+		if c.file != "" {
+			environ = append(environ, "PASTECAT_CONFIG="+writeConfigFile(t, c.file))
+		}
+		_, err := loadConfig(c.args, environ)
+		if err == nil {
+			t.Errorf("loadConfig(%q, %q) did not error as expected", c.args, environ)
+		} else if !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("loadConfig(%q, %q) got error %q, want it to contain %q",
+				c.args, environ, err, c.wantErr)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	old, err := loadConfig([]string{"-l", ":1"}, []string{"PASTECAT_LIFETIME=1h"})
+	if err != nil {
+		t.Fatalf("loadConfig errored unexpectedly: %v", err)
+	}
+	environ := []string{
+		"PASTECAT_LIFETIME=2h",
+		"PASTECAT_MAX_NUMBER=7",
+		"PASTECAT_UPLOAD_RATE=5",
+		"PASTECAT_DEDUP=true",
+		"PASTECAT_STORAGE_DIR=/elsewhere",
+	}
+	c, fixed, err := reloadConfig(old, []string{"-l", ":2"}, environ)
+	if err != nil {
+		t.Fatalf("reloadConfig errored unexpectedly: %v", err)
+	}
+	wantFixed := []string{"listen", "dedup", "upload_rate", "storage.dir"}
+	if !reflect.DeepEqual(fixed, wantFixed) {
+		t.Errorf("reloadConfig got fixed %q, want %q", fixed, wantFixed)
+	}
+	if c.lifeTime != 2*time.Hour || c.maxNumber != 7 {
+		t.Errorf("reloadConfig did not apply the live settings, got %s and %d", c.lifeTime, c.maxNumber)
+	}
+	if c.listen != ":1" || c.dedup || c.uploadRate != 0 {
+		t.Errorf("reloadConfig changed the fixed settings, got %q, %t and %v",
+			c.listen, c.dedup, c.uploadRate)
+	}
+	if c.storageParams["dir"] != "pastes" {
+		t.Errorf("reloadConfig changed the storage dir to %q", c.storageParams["dir"])
+	}
+
+	if _, _, err := reloadConfig(old, nil, []string{"PASTECAT_FOO=1"}); err == nil {
+		t.Errorf("reloadConfig with an unknown setting did not error as expected")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Path under which the metrics are served
+const metricsPath = "/metrics"
+
+// Upper bounds in seconds of the request latency histogram buckets
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Kinds of requests that metrics are kept for
+const (
+	kindUpload = "upload"
+	kindRead   = "read"
+	kindDelete = "delete"
+	kindOther  = "other"
+)
+
+// metrics keeps the counters exported in the Prometheus text format
+type metrics struct {
+	sync.Mutex
+	backend string
+	// the stats of the pastes, and of the storage they actually use
+	stats, physical *storage.Stats
+	expirer         *storage.Expirer
+
+	requests    map[requestKey]int64
+	latencies   map[string]*histogram
+	storeErrors map[string]int64
+}
+
+type requestKey struct {
+	kind string
+	code int
+}
+
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func newMetrics(backend string, stats, physical *storage.Stats, expirer *storage.Expirer) *metrics {
+	return &metrics{
+		backend:     backend,
+		stats:       stats,
+		physical:    physical,
+		expirer:     expirer,
+		requests:    make(map[requestKey]int64),
+		latencies:   make(map[string]*histogram),
+		storeErrors: make(map[string]int64),
+	}
+}
+
+// requestKind returns the kind of request r is for the metrics.
+func requestKind(r *http.Request) string {
+	switch {
+	case r.Method == "DELETE", r.Method == "POST" && r.URL.Path == "/delete":
+		return kindDelete
+	case r.Method == "POST", r.Method == "PUT":
+		return kindUpload
+	case r.Method != "GET", r.URL.Path == metricsPath:
+		return kindOther
+	case strings.HasPrefix(r.URL.Path, apiPrefix):
+		return kindOther
+	}
+	if _, e := templates[r.URL.Path]; e {
+		return kindOther
+	}
+	return kindRead
+}
+
+// statusRecorder keeps the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.code == 0 {
+		sr.code = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.code == 0 {
+		sr.code = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+// instrument wraps h to record the status codes and latencies of requests.
+func (m *metrics) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(sr, r)
+		if sr.code == 0 {
+			sr.code = http.StatusOK
+		}
+		m.observe(requestKind(r), sr.code, time.Since(start))
+	})
+}
+
+func (m *metrics) observe(kind string, code int, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests[requestKey{kind, code}]++
+	hist, e := m.latencies[kind]
+	if !e {
+		hist = &histogram{counts: make([]int64, len(latencyBuckets))}
+		m.latencies[kind] = hist
+	}
+	secs := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if secs <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += secs
+}
+
+// storeError records an unexpected error from the store during op.
+func (m *metrics) storeError(op string) {
+	m.Lock()
+	m.storeErrors[op]++
+	m.Unlock()
+}
+
+func writeMetric(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.writeTo(w)
+}
+
+func (m *metrics) writeTo(w io.Writer) {
+	num, stg := m.stats.Report()
+	writeMetric(w, "pastecat_pastes", "gauge", "Number of pastes stored.")
+	fmt.Fprintf(w, "pastecat_pastes %d\n", num)
+	writeMetric(w, "pastecat_storage_bytes", "gauge", "Bytes used by the pastes stored.")
+	fmt.Fprintf(w, "pastecat_storage_bytes %d\n", stg)
+	_, phys := m.physical.Report()
+	writeMetric(w, "pastecat_physical_storage_bytes", "gauge", "Bytes actually used in the storage backend.")
+	fmt.Fprintf(w, "pastecat_physical_storage_bytes %d\n", phys)
+	maxNum, _ := m.stats.Limits()
+	_, maxStg := m.physical.Limits()
+	writeMetric(w, "pastecat_max_pastes", "gauge", "Maximum number of pastes, 0 being no limit.")
+	fmt.Fprintf(w, "pastecat_max_pastes %d\n", maxNum)
+	writeMetric(w, "pastecat_max_storage_bytes", "gauge", "Maximum bytes used by pastes, 0 being no limit.")
+	fmt.Fprintf(w, "pastecat_max_storage_bytes %d\n", maxStg)
+	writeMetric(w, "pastecat_max_paste_bytes", "gauge", "Maximum size of a paste, 0 being no limit.")
+	fmt.Fprintf(w, "pastecat_max_paste_bytes %d\n", int64(conf().maxSize))
+
+	exp := m.expirer.Report()
+	writeMetric(w, "pastecat_expiry_pending", "gauge", "Number of pastes pending deletion.")
+	fmt.Fprintf(w, "pastecat_expiry_pending %d\n", exp.Pending)
+	writeMetric(w, "pastecat_expiry_deleted_total", "counter", "Number of pastes deleted once expired.")
+	fmt.Fprintf(w, "pastecat_expiry_deleted_total %d\n", exp.Deleted)
+	writeMetric(w, "pastecat_expiry_retries_total", "counter", "Number of failed deletions that were retried.")
+	fmt.Fprintf(w, "pastecat_expiry_retries_total %d\n", exp.Retried)
+	writeMetric(w, "pastecat_expiry_give_ups_total", "counter", "Number of deletions that were given up on.")
+	fmt.Fprintf(w, "pastecat_expiry_give_ups_total %d\n", exp.GaveUp)
+
+	m.Lock()
+	defer m.Unlock()
+	for _, kind := range []string{kindUpload, kindRead} {
+		name := fmt.Sprintf("pastecat_%ss_total", kind)
+		writeMetric(w, name, "counter", fmt.Sprintf("Number of %s requests by status code.", kind))
+		var keys []requestKey
+		for key := range m.requests {
+			if key.kind == kind {
+				keys = append(keys, key)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].code < keys[j].code })
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s{code=\"%d\"} %d\n", name, key.code, m.requests[key])
+		}
+	}
+
+	writeMetric(w, "pastecat_request_duration_seconds", "histogram", "Latency of requests by kind.")
+	var kinds []string
+	for kind := range m.latencies {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		hist := m.latencies[kind]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "pastecat_request_duration_seconds_bucket{kind=\"%s\",le=\"%g\"} %d\n",
+				kind, bound, hist.counts[i])
+		}
+		fmt.Fprintf(w, "pastecat_request_duration_seconds_bucket{kind=\"%s\",le=\"+Inf\"} %d\n", kind, hist.count)
+		fmt.Fprintf(w, "pastecat_request_duration_seconds_sum{kind=\"%s\"} %g\n", kind, hist.sum)
+		fmt.Fprintf(w, "pastecat_request_duration_seconds_count{kind=\"%s\"} %d\n", kind, hist.count)
+	}
+
+	writeMetric(w, "pastecat_store_errors_total", "counter", "Number of unexpected errors from the store by operation.")
+	var ops []string
+	for op := range m.storeErrors {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		fmt.Fprintf(w, "pastecat_store_errors_total{backend=\"%s\",op=\"%s\"} %d\n",
+			m.backend, op, m.storeErrors[op])
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestKind(t *testing.T) {
+	for _, c := range []struct {
+		method, target string
+		want           string
+	}{
+		{"GET", "/a63d03b9", kindRead},
+		{"GET", "/~build.log", kindRead},
+		{"GET", "/", kindOther},
+		{"GET", "/form", kindOther},
+		{"GET", metricsPath, kindOther},
+		{"GET", apiPrefix + apiPastes + "/a63d03b9", kindOther},
+		{"POST", "/", kindUpload},
+		{"POST", "/redirect", kindUpload},
+		{"PUT", "/file.txt", kindUpload},
+		{"POST", apiPrefix + apiPastes, kindUpload},
+		{"POST", "/delete", kindDelete},
+		{"DELETE", "/a63d03b9", kindDelete},
+		{"HEAD", "/a63d03b9", kindOther},
+	} {
+		r := httptest.NewRequest(c.method, c.target, nil)
+		if got := requestKind(r); got != c.want {
+			t.Errorf("requestKind(%s %s) got %s, want %s", c.method, c.target, got, c.want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h := newTestHandler(t)
+	m := h.metrics
+	handler := m.instrument(h)
+	id, _ := mustUpload(t, handler, "foo")
+	wantResponse(t, serve(handler, "GET", "/"+id, nil), "GET", http.StatusOK, "foo")
+	wantResponse(t, serve(handler, "GET", "/"+id+"0", nil), "GET of a missing paste", http.StatusNotFound, "")
+	wantResponse(t, serve(handler, "DELETE", "/"+id, nil), "DELETE without token", http.StatusForbidden, "")
+	m.storeError("get")
+	m.observe(kindOther, http.StatusOK, 20*time.Millisecond)
+
+	w := serve(m, "GET", metricsPath, nil)
+	wantResponse(t, w, "GET of the metrics", http.StatusOK, "")
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("GET of the metrics got Content-Type %q", got)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE pastecat_pastes gauge\n",
+		"pastecat_pastes 1\n",
+		"pastecat_storage_bytes 3\n",
+		"pastecat_max_paste_bytes 1048576\n",
+		"pastecat_expiry_pending 1\n",
+		`pastecat_uploads_total{code="200"} 1` + "\n",
+		`pastecat_reads_total{code="200"} 1` + "\n",
+		`pastecat_reads_total{code="404"} 1` + "\n",
+		`pastecat_request_duration_seconds_count{kind="read"} 2` + "\n",
+		`pastecat_request_duration_seconds_count{kind="delete"} 1` + "\n",
+		`pastecat_request_duration_seconds_bucket{kind="other",le="0.01"} 0` + "\n",
+		`pastecat_request_duration_seconds_bucket{kind="other",le="0.025"} 1` + "\n",
+		`pastecat_request_duration_seconds_bucket{kind="other",le="+Inf"} 1` + "\n",
+		`pastecat_store_errors_total{backend="mem",op="get"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
@@ -4,12 +4,26 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mvdan/pastecat/storage"
@@ -18,238 +32,1048 @@ import (
 const (
 	// Name of the HTTP form field when uploading a paste
 	fieldName = "paste"
+	// Name of the HTTP form field or header to request a lifetime for a
+	// new paste, capped by the lifetime of the pastes
+	expireName = "expire"
+	// Value of the lifetime requested for pastes that should not expire
+	expireNever = "never"
+	// Name of the HTTP form field or header to request a new paste to be
+	// deleted once it has been read
+	burnName = "burn"
+	// Name of the HTTP form field or header to mark a new paste as
+	// encrypted by the uploader, and of the header telling so when
+	// serving it
+	encryptedName = "encrypted"
+	// Name of the HTTP form field or header to set the password required
+	// to read a new paste, and of the query parameter to give it back
+	passwordName = "password"
+	// Name of the HTTP form field or header to request a name for a new
+	// paste, which is served under it prefixed by a tilde
+	vanityName = "name"
+	// Realm of the HTTP Basic authentication to read pastes with a
+	// password
+	passwordRealm = "pastecat"
+	// Name of the HTTP header holding the token to delete a new paste
+	// with, and of the form field or header to give it back when deleting
+	tokenName = "delete-token"
+	// Name of the HTTP form field holding the paste to delete when using
+	// the web form
+	idName = "id"
+	// Maximum size of the HTTP form values and headers read alongside a
+	// paste
+	maxValueSize = 1 << 10
+	// Maximum size of the urlencoded form fields before a paste, past
+	// which the body is taken as the paste itself
+	maxFormPrefix = 16 * maxValueSize
+	// Prefix of the HTTP headers given by uploaders to be served along
+	// with their pastes
+	customHeaderPrefix = "X-Paste-"
+	// Maximum number of custom headers per paste
+	maxCustomHeaders = 16
 	// Content-Type when serving pastes
 	contentType = "text/plain; charset=utf-8"
 	// Report usage stats how often
 	reportInterval = 1 * time.Minute
+	// Write the views of pastes counted in memory to the store how often
+	viewsInterval = 30 * time.Second
+	// How long to wait for the requests in flight when shutting down
+	shutdownTimeout = 30 * time.Second
 
 	// HTTP response strings
 	invalidID     = "invalid paste id"
+	invalidToken  = "invalid delete token"
 	unknownAction = "unsupported action"
+	alreadyRead   = "paste has been read already"
 )
 
 var (
-	siteURL   = flag.String("u", "http://localhost:8080", "URL of the site")
-	listen    = flag.String("l", ":8080", "Host and port to listen to")
-	lifeTime  = flag.Duration("t", 24*time.Hour, "Lifetime of the pastes")
-	timeout   = flag.Duration("T", 5*time.Second, "Timeout of HTTP requests")
-	maxNumber = flag.Int("m", 0, "Maximum number of pastes to store at once")
-
-	maxSize    = 1 * storage.MB
-	maxStorage = 1 * storage.GB
+	errPasswordRequired = errors.New("password required")
+	errInvalidPassword  = errors.New("invalid password")
+	errFieldAfterPaste  = errors.New("form fields must go before the paste")
+	errFormValueTooLong = errors.New("form value too long")
+	errInvalidEscape    = errors.New("invalid escape in form value")
 )
 
-func init() {
-	flag.Var(&maxSize, "s", "Maximum size of pastes")
-	flag.Var(&maxStorage, "M", "Maximum storage size to use at once")
+// getContent returns a reader for the content of the paste being uploaded,
+// filling in the metadata that comes with it. Forms and raw bodies are
+// streamed instead of being read into memory first. Once the paste has
+// been read, the returned func must be called to check that no form fields
+// followed it, as those would have been missed.
+func getContent(r *http.Request, meta *storage.Metadata) (io.Reader, func() error, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case r.Method == "PUT":
+		return getContentFromBody(r, meta, path.Base(r.URL.Path))
+	case mediaType == "multipart/form-data":
+		return getContentFromMultipart(r, meta)
+	case mediaType == "application/x-www-form-urlencoded":
+		return getContentFromForm(r)
+	}
+	return getContentFromBody(r, meta, "")
+}
+
+// noFieldsAfter is used when nothing can follow the paste.
+func noFieldsAfter() error { return nil }
+
+// getContentFromBody uses the entire request body as the paste. Only the
+// URL query is used for form values.
+func getContentFromBody(r *http.Request, meta *storage.Metadata, filename string) (io.Reader, func() error, error) {
+	if filename != "/" && filename != "." && len(filename) <= maxValueSize {
+		meta.Filename = filename
+	}
+	meta.ContentType = r.Header.Get("Content-Type")
+	r.Form = r.URL.Query()
+	r.PostForm = make(url.Values)
+	return r.Body, noFieldsAfter, nil
+}
+
+func getContentFromMultipart(r *http.Request, meta *storage.Metadata) (io.Reader, func() error, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, err
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	fieldsAfter := func() error {
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if part.FileName() == "" {
+				return errFieldAfterPaste
+			}
+		}
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, nil, storage.ErrEmptyPaste
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if part.FormName() == fieldName {
+			if filename := part.FileName(); len(filename) <= maxValueSize {
+				meta.Filename = filename
+			}
+			meta.ContentType = part.Header.Get("Content-Type")
+			return part, fieldsAfter, nil
+		}
+		if part.FileName() != "" {
+			continue
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxValueSize))
+		if err != nil {
+			return nil, nil, err
+		}
+		r.Form.Add(part.FormName(), string(value))
+	}
+}
+
+// getContentFromForm streams the paste form field, reading the fields before
+// it into the form values. If the start of the body holds no paste field, it
+// is taken as the paste itself, as is the case with tools like curl
+// --data-binary.
+func getContentFromForm(r *http.Request) (io.Reader, func() error, error) {
+	br := bufio.NewReaderSize(r.Body, maxFormPrefix)
+	start, _ := br.Peek(maxFormPrefix)
+	fields, n, err := splitForm(start)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.Form = r.URL.Query()
+	r.PostForm = make(url.Values)
+	if n < 0 {
+		return br, noFieldsAfter, nil
+	}
+	br.Discard(n)
+	for key, values := range fields {
+		r.Form[key] = append(r.Form[key], values...)
+		r.PostForm[key] = values
+	}
+	fieldsAfter := func() error {
+		if _, err := br.ReadByte(); err == io.EOF {
+			return nil
+		}
+		return errFieldAfterPaste
+	}
+	return &formValueReader{br: br}, fieldsAfter, nil
 }
 
-func getContentFromForm(r *http.Request) ([]byte, error) {
-	if value := r.FormValue(fieldName); len(value) > 0 {
-		return []byte(value), nil
+// splitForm looks for the paste field at the start of a urlencoded body,
+// returning the fields before it and the offset at which its value starts.
+// The offset is -1 if the paste field is not there.
+func splitForm(start []byte) (url.Values, int, error) {
+	fields := make(url.Values)
+	var fieldsErr error
+	for off := 0; off < len(start); {
+		end := bytes.IndexByte(start[off:], '&')
+		if end < 0 {
+			end = len(start) - off
+		}
+		field := start[off : off+end]
+		rawKey, rawValue := field, []byte(nil)
+		i := bytes.IndexByte(field, '=')
+		if i >= 0 {
+			rawKey, rawValue = field[:i], field[i+1:]
+		}
+		key, err := url.QueryUnescape(string(rawKey))
+		if i >= 0 && err == nil && key == fieldName {
+			return fields, off + i + 1, fieldsErr
+		}
+		value, valueErr := url.QueryUnescape(string(rawValue))
+		switch {
+		case fieldsErr != nil:
+		case err != nil, valueErr != nil:
+			fieldsErr = errInvalidEscape
+		case len(value) > maxValueSize:
+			fieldsErr = errFormValueTooLong
+		case key != "":
+			fields.Add(key, value)
+		}
+		off += end + 1
 	}
-	if f, _, err := r.FormFile(fieldName); err == nil {
-		defer f.Close()
-		content, err := ioutil.ReadAll(f)
-		if err == nil && len(content) > 0 {
-			return content, nil
+	return nil, -1, nil
+}
+
+// formValueReader unescapes a urlencoded form value as it is read, stopping
+// at the end of the value.
+type formValueReader struct {
+	br   *bufio.Reader
+	done bool
+}
+
+func (fr *formValueReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && !fr.done {
+		c, err := fr.br.ReadByte()
+		if err == io.EOF {
+			fr.done = true
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		switch c {
+		case '&':
+			fr.done = true
+			continue
+		case '+':
+			c = ' '
+		case '%':
+			var hex [2]byte
+			if _, err := io.ReadFull(fr.br, hex[:]); err != nil {
+				return n, errInvalidEscape
+			}
+			s, err := url.QueryUnescape("%" + string(hex[:]))
+			if err != nil {
+				return n, errInvalidEscape
+			}
+			c = s[0]
+		}
+		p[n] = c
+		n++
+	}
+	if n == 0 && fr.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// getCustomHeader returns the custom headers given by the uploader, to be
+// served along with the paste.
+func getCustomHeader(r *http.Request) (map[string]string, error) {
+	var header map[string]string
+	for name, values := range r.Header {
+		if !strings.HasPrefix(name, customHeaderPrefix) {
+			continue
+		}
+		if len(header) == maxCustomHeaders {
+			return nil, fmt.Errorf("too many %s* headers", customHeaderPrefix)
+		}
+		value := strings.Join(values, ", ")
+		if len(value) > maxValueSize {
+			return nil, fmt.Errorf("%s header too long", name)
+		}
+		if header == nil {
+			header = make(map[string]string)
+		}
+		header[name] = value
+	}
+	return header, nil
+}
+
+// getExpires returns when a new paste should be deleted. The uploader may
+// request a lifetime, which is capped by the lifetime of the pastes.
+func getExpires(r *http.Request, now time.Time) (time.Time, error) {
+	value := formOrHeader(r, expireName)
+	life := conf().lifeTime
+	switch value {
+	case "", expireNever:
+	default:
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return time.Time{}, fmt.Errorf("invalid %s value: %s", expireName, value)
+		}
+		if life == 0 || d < life {
+			life = d
 		}
 	}
-	return nil, errors.New("no paste provided")
+	if life == 0 {
+		return time.Time{}, nil
+	}
+	return now.Add(life), nil
+}
+
+// getBool returns the boolean value of an option for a new paste, such as
+// whether it should be deleted once it has been read.
+func getBool(r *http.Request, name string) (bool, error) {
+	value := formOrHeader(r, name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value: %s", name, value)
+	}
+	return b, nil
+}
+
+// formOrHeader returns the value of an option given via either a form
+// field or a header, the former taking precedence.
+func formOrHeader(r *http.Request, name string) string {
+	if value := r.FormValue(name); value != "" {
+		return value
+	}
+	return r.Header.Get(name)
 }
 
 func setHeaders(header http.Header, id storage.ID, paste storage.Paste) {
 	modTime := paste.ModTime()
+	meta := paste.Metadata()
 	header.Set("Etag", fmt.Sprintf(`"%d-%s"`, modTime.Unix(), id))
-	if *lifeTime > 0 {
-		deathTime := modTime.Add(*lifeTime)
+	var cacheControl []string
+	if meta.PasswordHash != "" {
+		// shared caches would serve it without asking for the password
+		cacheControl = append(cacheControl, "private")
+	}
+	if deathTime := meta.Expires; !deathTime.IsZero() {
 		lifeLeft := deathTime.Sub(time.Now())
 		header.Set("Expires", deathTime.UTC().Format(http.TimeFormat))
-		header.Set("Cache-Control", fmt.Sprintf(
+		cacheControl = append(cacheControl, fmt.Sprintf(
 			"max-age=%.f, must-revalidate", lifeLeft.Seconds()))
 	}
+	if len(cacheControl) > 0 {
+		header.Set("Cache-Control", strings.Join(cacheControl, ", "))
+	}
 	header.Set("Content-Type", contentType)
+	setMetaHeaders(header, meta)
+}
+
+// setMetaHeaders sets the headers that come from the metadata of a paste.
+func setMetaHeaders(header http.Header, meta storage.Metadata) {
+	if meta.Filename != "" {
+		header.Set("Content-Disposition", mime.FormatMediaType("inline",
+			map[string]string{"filename": meta.Filename}))
+	}
+	for name, value := range meta.Header {
+		header.Set(name, value)
+	}
+	if meta.Encrypted {
+		header.Set(encryptedName, "true")
+	}
+}
+
+// servedContent returns the content of paste to serve for r, along with its
+// size. Content kept encoded is served as is if the client accepts its
+// encoding, setting the headers that go with it.
+func servedContent(header http.Header, r *http.Request, paste storage.Paste) (io.ReadSeeker, int64) {
+	ep, ok := paste.(storage.EncodedPaste)
+	if !ok {
+		return paste, paste.Size()
+	}
+	header.Add("Vary", "Accept-Encoding")
+	encoding := ep.Encoding()
+	if !acceptsEncoding(r, encoding) {
+		return paste, paste.Size()
+	}
+	header.Set("Content-Encoding", encoding)
+	if etag := header.Get("Etag"); etag != "" {
+		// ranges of each encoding are different
+		header.Set("Etag", strings.TrimSuffix(etag, `"`)+"-"+encoding+`"`)
+	}
+	return ep.Encoded()
+}
+
+// acceptsEncoding reports whether the client that sent r accepts content in
+// the given encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		if _, q, e := strings.Cut(strings.TrimSpace(params), "q="); e {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
 }
 
 type httpHandler struct {
 	store storage.Store
 	stats *storage.Stats
+	// stats of the storage actually used, which differ from stats when
+	// wrapping the store
+	physical *storage.Stats
+	expirer  *storage.Expirer
+	metrics  *metrics
+	// limits on the uploads per client, if any
+	limiter *limiter
+	// pastes being served before being deleted for having been read
+	burning *idSet
+	// views of pastes not yet written to the store
+	views *viewCounter
+}
+
+// idSet is a set of paste IDs safe for concurrent use
+type idSet struct {
+	sync.Mutex
+	m map[storage.ID]struct{}
+}
+
+// add adds id to the set, returning false if it was already in it.
+func (s *idSet) add(id storage.ID) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, e := s.m[id]; e {
+		return false
+	}
+	s.m[id] = struct{}{}
+	return true
+}
+
+func (s *idSet) remove(id storage.ID) {
+	s.Lock()
+	delete(s.m, id)
+	s.Unlock()
 }
 
 func (h httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, apiPrefix) {
+		h.serveAPI(w, r, r.URL.Path[len(apiPrefix):])
+		return
+	}
 	switch r.Method {
 	case "GET":
 		h.handleGet(w, r)
 	case "POST":
+		if r.URL.Path == "/delete" {
+			h.handleDelete(w, r, path.Base(r.FormValue(idName)))
+		} else {
+			h.handlePost(w, r)
+		}
+	case "PUT":
 		h.handlePost(w, r)
+	case "DELETE":
+		h.handleDelete(w, r, r.URL.Path[1:])
 	default:
 		http.Error(w, unknownAction, http.StatusBadRequest)
 	}
 }
 
+// getPaste returns the paste known by the ID as given by the client. Pastes
+// that have expired are not found, even before they are deleted. If it
+// fails, it returns the HTTP status code to reply with along with the error.
+func (h *httpHandler) getPaste(rawID string) (storage.ID, storage.Paste, int, error) {
+	id, err := storage.IDFromString(rawID)
+	if err != nil {
+		return id, nil, http.StatusBadRequest, errors.New(invalidID)
+	}
+	paste, err := h.store.Get(id)
+	lower := storage.ID(strings.ToLower(id.String()))
+	if err == storage.ErrPasteNotFound && lower != id && !id.Named() && conf().idFormat.CaseInsensitive() {
+		// the exact ID goes first, as it may be in base62 from
+		// before changing the format
+		id = lower
+		paste, err = h.store.Get(id)
+	}
+	if err == storage.ErrPasteNotFound {
+		return id, nil, http.StatusNotFound, err
+	} else if err != nil {
+		log.Printf("Unknown error on GET: %v", err)
+		h.metrics.storeError("get")
+		return id, nil, http.StatusInternalServerError, err
+	}
+	if paste.Metadata().Expired(time.Now()) {
+		// yet to be deleted by the expirer
+		paste.Close()
+		return id, nil, http.StatusNotFound, storage.ErrPasteNotFound
+	}
+	return id, paste, http.StatusOK, nil
+}
+
+// passwordHashes limits the passwords hashed at once, when checking them
+// or when uploading new pastes with them
+var passwordHashes = newHashLimiter(runtime.NumCPU(), hashWait)
+
+// checkPassword returns an error and the HTTP status code to reply with if
+// the paste requires a password and r does not hold it, either via HTTP
+// Basic authentication with any user name or via the query. If so, it sets
+// the header asking for it. Passwords are not checked when too many are
+// being hashed already.
+func checkPassword(w http.ResponseWriter, r *http.Request, meta storage.Metadata) (int, error) {
+	if meta.PasswordHash == "" {
+		return http.StatusOK, nil
+	}
+	password := r.URL.Query().Get(passwordName)
+	if _, p, ok := r.BasicAuth(); ok {
+		password = p
+	}
+	if password != "" {
+		done, err := passwordHashes.begin(w, r)
+		if err != nil {
+			return http.StatusTooManyRequests, err
+		}
+		valid := meta.CheckPassword(password)
+		done()
+		if valid {
+			return http.StatusOK, nil
+		}
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, passwordRealm))
+	if password == "" {
+		return http.StatusUnauthorized, errPasswordRequired
+	}
+	return http.StatusUnauthorized, errInvalidPassword
+}
+
 func (h *httpHandler) handleGet(w http.ResponseWriter, r *http.Request) {
 	if _, e := templates[r.URL.Path]; e {
-		err := tmpl.ExecuteTemplate(w, r.URL.Path,
+		c := conf()
+		err := tmpl.Load().ExecuteTemplate(w, r.URL.Path,
 			struct {
-				SiteURL   string
-				MaxSize   storage.ByteSize
-				LifeTime  time.Duration
-				FieldName string
+				SiteURL       string
+				MaxSize       storage.ByteSize
+				LifeTime      time.Duration
+				FieldName     string
+				ExpireName    string
+				ExpireNever   string
+				BurnName      string
+				TokenName     string
+				IDName        string
+				EncryptedName string
+				PasswordName  string
+				VanityName    string
+				Iterations    int
+				MACHeader     string
 			}{
-				SiteURL:   *siteURL,
-				MaxSize:   maxSize,
-				LifeTime:  *lifeTime,
-				FieldName: fieldName,
+				SiteURL:       siteURLFor(r),
+				MaxSize:       c.maxSize,
+				LifeTime:      c.lifeTime,
+				FieldName:     fieldName,
+				ExpireName:    expireName,
+				ExpireNever:   expireNever,
+				BurnName:      burnName,
+				TokenName:     tokenName,
+				IDName:        idName,
+				EncryptedName: encryptedName,
+				PasswordName:  passwordName,
+				VanityName:    vanityName,
+				Iterations:    secretIterations,
+				MACHeader:     secretMACHeader,
 			})
 		if err != nil {
 			log.Printf("Error executing template for %s: %v", r.URL.Path, err)
 		}
 		return
 	}
-	id, err := storage.IDFromString(r.URL.Path[1:])
+	id, paste, status, err := h.getPaste(r.URL.Path[1:])
 	if err != nil {
-		http.Error(w, invalidID, http.StatusBadRequest)
+		http.Error(w, err.Error(), status)
 		return
 	}
-	paste, err := h.store.Get(id)
-	if err == storage.ErrPasteNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	if status, err := checkPassword(w, r, paste.Metadata()); err != nil {
+		paste.Close()
+		http.Error(w, err.Error(), status)
 		return
-	} else if err != nil {
-		log.Printf("Unknown error on GET: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	if paste.Metadata().Burn {
+		h.serveBurn(w, r, id, paste)
 		return
 	}
-	defer paste.Close()
 	setHeaders(w.Header(), id, paste)
-	http.ServeContent(w, r, "", paste.ModTime(), paste)
+	content, _ := servedContent(w.Header(), r, paste)
+	http.ServeContent(w, r, "", paste.ModTime(), content)
+	paste.Close()
+	h.views.count(id)
 }
 
-func (h *httpHandler) handlePost(w http.ResponseWriter, r *http.Request) {
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxSize))
-	content, err := getContentFromForm(r)
-	size := int64(len(content))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+// serveBurn serves a paste that is to be deleted once read. Only the first
+// reader gets its content, so any others racing it are told that it is gone.
+// Caching and ranges are not supported as a result.
+func (h *httpHandler) serveBurn(w http.ResponseWriter, r *http.Request, id storage.ID, paste storage.Paste) {
+	if !h.burning.add(id) {
+		paste.Close()
+		http.Error(w, alreadyRead, http.StatusGone)
 		return
 	}
-	if err := h.stats.MakeSpaceFor(size); err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	header := w.Header()
+	header.Set("Cache-Control", "no-store")
+	header.Set("Content-Type", contentType)
+	content, size := servedContent(header, r, paste)
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+	setMetaHeaders(header, paste.Metadata())
+	io.Copy(w, content)
+	paste.Close()
+	if err := h.store.Delete(id); err != nil && err != storage.ErrPasteNotFound {
+		// keep it claimed so that nobody else can read it
+		log.Printf("Could not delete %s after reading it: %v", id, err)
+		h.metrics.storeError("delete")
+		return
+	}
+	h.burning.remove(id)
+}
+
+// postStatus returns the HTTP status code to reply with when uploading a
+// paste fails with err, falling back to def for unknown errors.
+func postStatus(err error, def int) int {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case err == storage.ErrEmptyPaste, err == storage.ErrNamesUnsupported,
+		errors.Is(err, errInvalidEscape):
+		return http.StatusBadRequest
+	case err == storage.ErrNameTaken:
+		return http.StatusConflict
+	case err == storage.ErrReachedMaxNumber, err == storage.ErrReachedMaxStorage:
+		return http.StatusServiceUnavailable
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case err == errRateLimited, errors.Is(err, errQuotaExceeded), err == errTooManyHashes:
+		return http.StatusTooManyRequests
+	}
+	return def
+}
+
+// newPaste holds the information about a paste that was just uploaded
+type newPaste struct {
+	id      storage.ID
+	meta    storage.Metadata
+	token   string
+	size    int64
+	created time.Time
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// putPaste stores the paste being uploaded via r. If it fails, it returns
+// the HTTP status code to reply with along with the error.
+func (h *httpHandler) putPaste(w http.ResponseWriter, r *http.Request) (*newPaste, int, error) {
+	c := conf()
+	if c.clientCAFile != "" && !hasClientCert(r) {
+		return nil, http.StatusForbidden, errClientCertRequired
+	}
+	quota, err := h.limiter.admit(w, r)
+	if err != nil {
+		return nil, http.StatusTooManyRequests, err
+	}
+	if c.maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(c.maxSize))
+	}
+	p := &newPaste{created: time.Now()}
+	p.meta.Uploader = clientAddr(r)
+	content, fieldsAfter, err := getContent(r, &p.meta)
+	if err == nil {
+		content = quota(content)
+		p.meta.Header, err = getCustomHeader(r)
+	}
+	if err == nil {
+		p.meta.Expires, err = getExpires(r, p.created)
+	}
+	if err == nil {
+		p.meta.Burn, err = getBool(r, burnName)
+	}
+	if err == nil {
+		p.meta.Encrypted, err = getBool(r, encryptedName)
+	}
+	if password := formOrHeader(r, passwordName); err == nil && password != "" {
+		var done func()
+		if done, err = passwordHashes.begin(w, r); err == nil {
+			p.meta.PasswordHash, err = storage.HashPassword(password)
+			done()
+		}
+	}
+	var name storage.ID
+	if value := formOrHeader(r, vanityName); err == nil && value != "" {
+		name, err = storage.NamedID(value)
+	}
+	if err == nil {
+		p.token, p.meta.DeleteHash, err = storage.NewDeleteToken()
+	}
+	if err != nil {
+		return nil, postStatus(err, http.StatusBadRequest), err
+	}
+	counter := &countingReader{r: content}
+	if name == "" {
+		p.id, err = h.store.Put(counter, p.meta)
+	} else if namer, ok := h.store.(storage.Namer); !ok {
+		err = storage.ErrNamesUnsupported
+	} else if err = namer.PutNamed(name, counter, p.meta); err == nil {
+		p.id = name
 	}
-	id, err := h.store.Put(content)
 	if err != nil {
-		log.Printf("Unknown error on POST: %v", err)
-		h.stats.FreeSpace(size)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		status := postStatus(err, http.StatusInternalServerError)
+		if status == http.StatusInternalServerError {
+			log.Printf("Unknown error on POST: %v", err)
+			h.metrics.storeError("put")
+		}
+		return nil, status, err
+	}
+	if err := fieldsAfter(); err != nil {
+		if err := h.store.Delete(p.id); err != nil {
+			log.Printf("Could not delete %s: %v", p.id, err)
+		}
+		return nil, http.StatusBadRequest, err
+	}
+	p.size = counter.n
+	return p, http.StatusOK, nil
+}
+
+func (h *httpHandler) handlePost(w http.ResponseWriter, r *http.Request) {
+	p, status, err := h.putPaste(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
 		return
 	}
-	storage.SetupPasteDeletion(h.store, h.stats, id, size, *lifeTime)
-	url := fmt.Sprintf("%s/%s", *siteURL, id)
-	switch r.URL.Path {
-	case "/redirect":
+	w.Header().Set(tokenName, p.token)
+	url := pasteURL(r, p.id)
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/redirect":
 		http.Redirect(w, r, url, 302)
 	default:
 		fmt.Fprintln(w, url)
 	}
 }
 
-func (h *httpHandler) setupStore(lifeTime time.Duration, storageType string, args []string) error {
-	params, e := map[string]map[string]string{
-		"fs": {
-			"dir": "pastes",
-		},
-		"fs-mmap": {
-			"dir": "pastes",
-		},
-		"mem": {},
-	}[storageType]
-	if !e {
-		return fmt.Errorf("unknown storage type '%s'", storageType)
+// deletePaste deletes the paste known by the ID as given by the client if r
+// holds its delete token. If it fails, it returns the HTTP status code to
+// reply with along with the error.
+func (h *httpHandler) deletePaste(r *http.Request, rawID string) (storage.ID, int, error) {
+	id, paste, status, err := h.getPaste(rawID)
+	if err != nil {
+		return id, status, err
 	}
-	if len(args) > len(params) {
-		return fmt.Errorf("too many arguments given for %s", storageType)
+	meta := paste.Metadata()
+	paste.Close()
+	if !meta.CheckDeleteToken(formOrHeader(r, tokenName)) {
+		return id, http.StatusForbidden, errors.New(invalidToken)
 	}
-	for k := range params {
-		if len(args) == 0 {
-			break
+	err = h.store.Delete(id)
+	if err == storage.ErrPasteNotFound {
+		return id, http.StatusNotFound, err
+	} else if err != nil {
+		log.Printf("Unknown error on DELETE: %v", err)
+		h.metrics.storeError("delete")
+		return id, http.StatusInternalServerError, err
+	}
+	return id, http.StatusOK, nil
+}
+
+func (h *httpHandler) handleDelete(w http.ResponseWriter, r *http.Request, rawID string) {
+	id, status, err := h.deletePaste(r, rawID)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	fmt.Fprintf(w, "deleted %s\n", id)
+}
+
+// storeWrapper wraps a store, accounting for the pastes in the given stats
+// and scheduling their deletion in the given expirer
+type storeWrapper func(inner storage.Lister, stats *storage.Stats, expirer *storage.Expirer) (storage.Lister, error)
+
+// storeWrappers returns the wrappers to set up the store with given c,
+// from the innermost to the outermost.
+func storeWrappers(c *config) ([]storeWrapper, error) {
+	var wrappers []storeWrapper
+	if c.encryptKeys != "" {
+		keys, err := storage.ReadKeyFile(c.encryptKeys)
+		if err != nil {
+			return nil, err
 		}
-		params[k] = args[0]
-		args = args[1:]
+		wrappers = append(wrappers, func(inner storage.Lister, stats *storage.Stats, expirer *storage.Expirer) (storage.Lister, error) {
+			log.Printf("Keeping pastes encrypted")
+			return storage.NewEncryptStore(inner, keys, stats, expirer)
+		})
+	}
+	if c.dedup {
+		wrappers = append(wrappers, func(inner storage.Lister, stats *storage.Stats, expirer *storage.Expirer) (storage.Lister, error) {
+			log.Printf("Keeping a single copy of pastes with the same content")
+			return storage.NewDedupStore(inner, stats, expirer)
+		})
 	}
-	var err error
-	switch storageType {
+	if c.compress {
+		wrappers = append(wrappers, func(inner storage.Lister, stats *storage.Stats, expirer *storage.Expirer) (storage.Lister, error) {
+			log.Printf("Keeping pastes compressed")
+			return storage.NewCompressStore(inner, stats, expirer)
+		})
+	}
+	return wrappers, nil
+}
+
+func (h *httpHandler) setupStore(c *config) error {
+	wrappers, err := storeWrappers(c)
+	if err != nil {
+		return err
+	}
+	h.stats = &storage.Stats{}
+	h.physical = h.stats
+	// only the outermost wrapper accounts for and deletes the pastes
+	// as seen by clients
+	expirer := h.expirer
+	if len(wrappers) > 0 {
+		h.physical = &storage.Stats{}
+		expirer = nil
+	}
+	h.setLimits(c)
+	params := c.storageParams
+	var store storage.Lister
+	switch c.storageType {
 	case "fs":
 		log.Printf("Starting up file store in the directory '%s'", params["dir"])
-		h.store, err = storage.NewFileStore(h.stats, lifeTime, params["dir"])
+		store, err = storage.NewFileStore(h.physical, expirer, c.lifeTime, params["dir"])
 	case "fs-mmap":
 		log.Printf("Starting up mmapped file store in the directory '%s'", params["dir"])
-		h.store, err = storage.NewMmapStore(h.stats, lifeTime, params["dir"])
+		store, err = storage.NewMmapStore(h.physical, expirer, c.lifeTime, params["dir"])
 	case "mem":
 		log.Printf("Starting up in-memory store")
-		h.store, err = storage.NewMemStore()
+		store, err = storage.NewMemStore(h.physical, expirer)
+	default:
+		return fmt.Errorf("unknown storage type '%s'", c.storageType)
 	}
+	for i, wrap := range wrappers {
+		if err != nil {
+			return err
+		}
+		// the bytes in between, which nothing limits
+		stats := &storage.Stats{}
+		if i == len(wrappers)-1 {
+			stats, expirer = h.stats, h.expirer
+		}
+		store, err = wrap(store, stats, expirer)
+	}
+	h.store = store
 	return err
 }
 
-func logStats(stats *storage.Stats) {
-	num, stg := stats.Report()
+// setLimits applies the limits in c. When wrapping the store, the number
+// of pastes is limited as they are seen by clients, while the storage is
+// limited as it is actually used.
+func (h *httpHandler) setLimits(c *config) {
+	if h.physical == h.stats {
+		h.stats.SetLimits(c.maxNumber, int64(c.maxStorage))
+		return
+	}
+	h.stats.SetLimits(c.maxNumber, 0)
+	h.physical.SetLimits(0, int64(c.maxStorage))
+}
+
+func logStats(stats, physical *storage.Stats, expirer *storage.Expirer) {
+	num, logical := stats.Report()
+	maxNum, _ := stats.Limits()
+	_, stg := physical.Report()
+	_, maxStg := physical.Limits()
 	var numStats, stgStats string
-	if stats.MaxNumber > 0 {
+	if maxNum > 0 {
 		numStats = fmt.Sprintf("%d (%.2f%% out of %d)", num,
-			float64(num*100)/float64(stats.MaxNumber), stats.MaxNumber)
+			float64(num*100)/float64(maxNum), maxNum)
 	} else {
 		numStats = fmt.Sprintf("%d", num)
 	}
-	if stats.MaxStorage > 0 {
+	if maxStg > 0 {
 		stgStats = fmt.Sprintf("%s (%.2f%% out of %s)", storage.ByteSize(stg),
-			float64(stg*100)/float64(stats.MaxStorage), storage.ByteSize(stats.MaxStorage))
+			float64(stg*100)/float64(maxStg), storage.ByteSize(maxStg))
 	} else {
 		stgStats = fmt.Sprintf("%s", storage.ByteSize(stg))
 	}
 	log.Printf("Have a total of %s pastes using %s", numStats, stgStats)
+	if physical != stats {
+		log.Printf("Their content adds up to %s", storage.ByteSize(logical))
+	}
+	exp := expirer.Report()
+	log.Printf("Have %d pastes pending deletion, deleted %d (%d retries, %d given up)",
+		exp.Pending, exp.Deleted, exp.Retried, exp.GaveUp)
+}
+
+// reloadOnSignal loads the configuration and templates again whenever
+// SIGHUP is received, applying the settings that can change while running.
+func reloadOnSignal(h *httpHandler) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		c, fixed, err := reloadConfig(conf(), os.Args[1:], os.Environ())
+		if err != nil {
+			log.Printf("Could not reload the configuration, keeping the old one: %v", err)
+			continue
+		}
+		t, err := loadTemplates(c.templatesDir)
+		if err != nil {
+			log.Printf("Could not reload the templates, keeping the old configuration: %v", err)
+			continue
+		}
+		for _, key := range fixed {
+			log.Printf("Cannot change %s while running, restart to apply it", key)
+		}
+		h.setLimits(c)
+		storage.SetIDFormat(c.idFormat)
+		tmpl.Store(t)
+		current.Store(c)
+		log.Printf("Reloaded the configuration")
+	}
+}
+
+// shutdownOnSignal waits for an interrupt or termination signal. Then it
+// stops the servers once the requests in flight are done, or forcibly once
+// shutdownTimeout passes, and closes the store after writing the views
+// counted so far.
+func shutdownOnSignal(h *httpHandler, done chan<- struct{}, servers ...*http.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	log.Printf("Received %s, shutting down", <-sigs)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Could not finish all requests to %s in time: %v", server.Addr, err)
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+	h.views.stop()
+	if err := h.store.Close(); err != nil {
+		log.Printf("Could not close the paste store: %v", err)
+	}
+	close(done)
 }
 
 func main() {
-	flag.Parse()
-	if maxStorage > 1*storage.EB {
-		log.Fatalf("Specified a maximum storage size that would overflow int64!")
+	c, err := loadConfig(os.Args[1:], os.Environ())
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
-	if maxSize > 1*storage.EB {
-		log.Fatalf("Specified a maximum paste size that would overflow int64!")
+	if c.print {
+		for _, line := range c.lines() {
+			fmt.Println(line)
+		}
+		return
 	}
-	loadTemplates()
+	t, err := loadTemplates(c.templatesDir)
+	if err != nil {
+		log.Fatalf("Could not load templates: %v", err)
+	}
+	tmpl.Store(t)
+	current.Store(c)
+	storage.SetIDFormat(c.idFormat)
 	var handler httpHandler
-	handler.stats = &storage.Stats{
-		MaxNumber:  *maxNumber,
-		MaxStorage: int64(maxStorage),
-	}
-	log.Printf("siteURL    = %s", *siteURL)
-	log.Printf("listen     = %s", *listen)
-	log.Printf("lifeTime   = %s", *lifeTime)
-	log.Printf("maxSize    = %s", maxSize)
-	log.Printf("maxNumber  = %d", *maxNumber)
-	log.Printf("maxStorage = %s", maxStorage)
-
-	args := flag.Args()
-	if len(args) == 0 {
-		args = []string{"fs"}
-	}
-	if err := handler.setupStore(*lifeTime, args[0], args[1:]); err != nil {
+	handler.burning = &idSet{m: make(map[storage.ID]struct{})}
+	handler.views = newViewCounter()
+	handler.expirer = storage.NewExpirer()
+	for _, line := range c.lines() {
+		if line != "" {
+			log.Print(line)
+		}
+	}
+
+	if err := handler.setupStore(c); err != nil {
 		log.Fatalf("Could not setup paste store: %v", err)
 	}
+	if c.evictPolicy != storage.EvictNone {
+		evictable, ok := handler.store.(storage.Evictable)
+		if !ok {
+			log.Fatalf("Storage type %s does not support eviction", c.storageType)
+		}
+		handler.stats.Evict = storage.EvictFunc(evictable, c.evictPolicy)
+		handler.physical.Evict = handler.stats.Evict
+	}
+
+	if c.uploadRate > 0 || c.uploadQuota > 0 {
+		handler.limiter = newLimiter(c.uploadRate, c.uploadBurst, int64(c.uploadQuota),
+			c.quotaWindow, c.clientPrefix, c.exemptClients)
+	}
+	handler.metrics = newMetrics(c.storageType, handler.stats, handler.physical, handler.expirer)
 
 	ticker := time.NewTicker(reportInterval)
 	go func() {
-		logStats(handler.stats)
+		logStats(handler.stats, handler.physical, handler.expirer)
 		for range ticker.C {
-			logStats(handler.stats)
+			logStats(handler.stats, handler.physical, handler.expirer)
 		}
 	}()
+	handler.views.start(handler.store, handler.metrics, viewsInterval)
 	var finalHandler http.Handler = handler
-	if *timeout > 0 {
-		finalHandler = http.TimeoutHandler(finalHandler, *timeout, "")
+	if c.timeout > 0 {
+		finalHandler = http.TimeoutHandler(finalHandler, c.timeout, "")
 	}
-	http.Handle("/", finalHandler)
+	http.Handle("/", handler.metrics.instrument(finalHandler))
+	http.Handle(metricsPath, handler.metrics)
+	server := &http.Server{Addr: c.listen}
+	servers := []*http.Server{server}
+	if c.certFile != "" {
+		tlsConfig, err := setupTLS(c.certFile, c.keyFile, c.clientCAFile)
+		if err != nil {
+			log.Fatalf("Could not setup TLS: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+		if c.redirectFrom != "" {
+			redirect := &http.Server{
+				Addr:    c.redirectFrom,
+				Handler: http.HandlerFunc(redirectHTTPS),
+			}
+			servers = append(servers, redirect)
+			go func() {
+				if err := redirect.ListenAndServe(); err != http.ErrServerClosed {
+					log.Fatal(err)
+				}
+			}()
+		}
+	}
+	go reloadOnSignal(&handler)
+	done := make(chan struct{})
+	go shutdownOnSignal(&handler, done, servers...)
 	log.Println("Up and running!")
-	log.Fatal(http.ListenAndServe(*listen, nil))
+	if c.certFile == "" {
+		err = server.ListenAndServe()
+	} else {
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+	log.Println("Shut down cleanly")
 }
@@ -0,0 +1,436 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// newTestHandler returns a handler with an in-memory store, using the
+// configuration given by args.
+func newTestHandler(t *testing.T, args ...string) *httpHandler {
+	t.Helper()
+	setConf(t, append(args, "mem")...)
+	h := &httpHandler{
+		expirer: storage.NewExpirer(),
+		burning: &idSet{m: make(map[storage.ID]struct{})},
+		views:   newViewCounter(),
+	}
+	if err := h.setupStore(conf()); err != nil {
+		t.Fatalf("Could not setup paste store: %v", err)
+	}
+	t.Cleanup(func() { h.store.Close() })
+	h.metrics = newMetrics("mem", h.stats, h.physical, h.expirer)
+	return h
+}
+
+// serve serves a request with the given method and target, returning the
+// response.
+func serve(h http.Handler, method, target string, header http.Header) *httptest.ResponseRecorder {
+	return serveBody(h, method, target, header, "")
+}
+
+// serveBody serves a request like serve, with the given body.
+func serveBody(h http.Handler, method, target string, header http.Header, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, values := range header {
+		for _, value := range values {
+			r.Header.Add(name, value)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// upload uploads a paste via a form to the given path, with the form fields
+// given as pairs of names and values before the content. It returns the
+// response.
+func upload(h http.Handler, target, content string, fields ...string) *httptest.ResponseRecorder {
+	form := make(url.Values)
+	for i := 0; i+1 < len(fields); i += 2 {
+		form.Add(fields[i], fields[i+1])
+	}
+	body := form.Encode()
+	if body != "" {
+		body += "&"
+	}
+	body += url.Values{fieldName: {content}}.Encode()
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// mustUpload uploads a paste like upload, returning its ID and delete token.
+func mustUpload(t *testing.T, h http.Handler, content string, fields ...string) (string, string) {
+	t.Helper()
+	w := upload(h, "/", content, fields...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Upload got %d: %s", w.Code, w.Body)
+	}
+	return path.Base(strings.TrimSpace(w.Body.String())), w.Header().Get(tokenName)
+}
+
+// wantResponse checks the status of a response, and its body if not empty.
+func wantResponse(t *testing.T, w *httptest.ResponseRecorder, what string, status int, body string) {
+	t.Helper()
+	if w.Code != status {
+		t.Errorf("%s got %d, want %d: %s", what, w.Code, status, w.Body)
+	} else if body != "" && w.Body.String() != body {
+		t.Errorf("%s got %q, want %q", what, w.Body, body)
+	}
+}
+
+func TestBurn(t *testing.T) {
+	h := newTestHandler(t)
+	id, _ := mustUpload(t, h, "foo", burnName, "true")
+
+	w := serve(h, "GET", apiPrefix+apiPastes+"/"+id, nil)
+	wantResponse(t, w, "GET of the information", http.StatusOK, "")
+	if !strings.Contains(w.Body.String(), `"burn":true`) {
+		t.Errorf("GET of the information is not marked as burn: %s", w.Body)
+	}
+
+	h.burning.add(storage.ID(id))
+	w = serve(h, "GET", "/"+id, nil)
+	wantResponse(t, w, "GET while being read", http.StatusGone, "")
+	h.burning.remove(storage.ID(id))
+
+	w = serve(h, "GET", "/"+id, nil)
+	wantResponse(t, w, "First GET", http.StatusOK, "foo")
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("First GET got Cache-Control %q, want %q", got, "no-store")
+	}
+	w = serve(h, "GET", "/"+id, nil)
+	wantResponse(t, w, "Second GET", http.StatusNotFound, "")
+}
+
+func TestBurnPassword(t *testing.T) {
+	h := newTestHandler(t)
+	id, _ := mustUpload(t, h, "foo", burnName, "true", passwordName, "secret")
+
+	w := serve(h, "GET", "/"+id, nil)
+	wantResponse(t, w, "GET without password", http.StatusUnauthorized, "")
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("GET without password did not ask for it")
+	}
+	w = serve(h, "GET", "/"+id+"?password=wrong", nil)
+	wantResponse(t, w, "GET with a wrong password", http.StatusUnauthorized, "")
+	w = serve(h, "GET", "/"+id+"?password=secret", nil)
+	wantResponse(t, w, "GET with the password", http.StatusOK, "foo")
+	w = serve(h, "GET", "/"+id+"?password=secret", nil)
+	wantResponse(t, w, "Second GET with the password", http.StatusNotFound, "")
+}
+
+func TestDeleteToken(t *testing.T) {
+	h := newTestHandler(t)
+	id, token := mustUpload(t, h, "foo")
+	if token == "" {
+		t.Fatalf("Upload did not give a delete token")
+	}
+
+	w := serve(h, "DELETE", "/"+id, nil)
+	wantResponse(t, w, "DELETE without token", http.StatusForbidden, "")
+	w = serve(h, "DELETE", "/"+id, http.Header{"Delete-Token": {token + "0"}})
+	wantResponse(t, w, "DELETE with a wrong token", http.StatusForbidden, "")
+	w = serve(h, "GET", "/"+id, nil)
+	wantResponse(t, w, "GET after failed deletes", http.StatusOK, "foo")
+
+	w = serve(h, "DELETE", "/"+id, http.Header{"Delete-Token": {token}})
+	wantResponse(t, w, "DELETE with the token", http.StatusOK, "deleted "+id+"\n")
+	w = serve(h, "GET", "/"+id, nil)
+	wantResponse(t, w, "GET after deleting", http.StatusNotFound, "")
+	w = serve(h, "DELETE", "/"+id, http.Header{"Delete-Token": {token}})
+	wantResponse(t, w, "Second DELETE", http.StatusNotFound, "")
+	w = serve(h, "DELETE", "/-invalid-", http.Header{"Delete-Token": {token}})
+	wantResponse(t, w, "DELETE of an invalid ID", http.StatusBadRequest, "")
+}
+
+func TestDeleteForm(t *testing.T) {
+	h := newTestHandler(t)
+	id, token := mustUpload(t, h, "foo")
+	for _, c := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusForbidden},
+		{"wrong", http.StatusForbidden},
+		{token, http.StatusOK},
+		{token, http.StatusNotFound},
+	} {
+		form := url.Values{idName: {id}, tokenName: {c.token}}
+		r := httptest.NewRequest("POST", "/delete", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		wantResponse(t, w, "POST on /delete with token "+c.token, c.status, "")
+	}
+}
+
+func TestExpired(t *testing.T) {
+	h := newTestHandler(t)
+	// without an expirer, like pastes not deleted yet
+	store, err := storage.NewMemStore(&storage.Stats{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.store = store
+	id, err := store.Put(strings.NewReader("foo"), storage.Metadata{Expires: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(h, "GET", "/"+id.String(), nil)
+	wantResponse(t, w, "GET of an expired paste", http.StatusNotFound, "")
+	w = serve(h, "GET", apiPrefix+apiPastes+"/"+id.String(), nil)
+	wantAPIError(t, w, "GET of the information of an expired paste", http.StatusNotFound)
+}
+
+func TestSplitForm(t *testing.T) {
+	long := strings.Repeat("x", maxValueSize+1)
+	for _, c := range []struct {
+		in      string
+		want    url.Values
+		wantOff int
+		wantErr error
+	}{
+		{"", nil, -1, nil},
+		{"paste=foo", url.Values{}, 6, nil},
+		{"expire=1h&burn=true&paste=foo", url.Values{"expire": {"1h"}, "burn": {"true"}}, 26, nil},
+		{"a=x+y%21&&b&paste=", url.Values{"a": {"x y!"}, "b": {""}}, 18, nil},
+		{"%70aste=foo", url.Values{}, 8, nil},
+		{"paste", nil, -1, nil},
+		{"pastes=foo", nil, -1, nil},
+		{"a=paste=foo", nil, -1, nil},
+		{"FOO=bar\nBAR=baz\n", nil, -1, nil},
+		{"a=%zz&paste=foo", nil, 12, errInvalidEscape},
+		{"a=%2&paste=foo", nil, 11, errInvalidEscape},
+		{"a=%zz", nil, -1, nil},
+		{"a=" + long + "&paste=foo", nil, maxValueSize + 10, errFormValueTooLong},
+	} {
+		got, off, err := splitForm([]byte(c.in))
+		if off != c.wantOff || err != c.wantErr {
+			t.Errorf("splitForm(%q) got offset %d and error %v, want %d and %v",
+				c.in, off, err, c.wantOff, c.wantErr)
+		} else if err == nil && !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitForm(%q) got %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestFormValueReader(t *testing.T) {
+	for _, c := range []struct {
+		in, want, rest string
+		wantErr        error
+	}{
+		{"", "", "", nil},
+		{"foo", "foo", "", nil},
+		{"a+b%20c%2B%26", "a b c+&", "", nil},
+		{"foo&expire=1h", "foo", "expire=1h", nil},
+		{"foo&", "foo", "", nil},
+		{"foo%", "foo", "", errInvalidEscape},
+		{"foo%4", "foo", "", errInvalidEscape},
+		{"foo%zz", "foo", "", errInvalidEscape},
+	} {
+		br := bufio.NewReader(strings.NewReader(c.in))
+		got, err := ioutil.ReadAll(&formValueReader{br: br})
+		rest, _ := ioutil.ReadAll(br)
+		if string(got) != c.want || err != c.wantErr {
+			t.Errorf("Reading %q got %q and error %v, want %q and %v", c.in, got, err, c.want, c.wantErr)
+		} else if err == nil && string(rest) != c.rest {
+			t.Errorf("Reading %q left %q, want %q", c.in, rest, c.rest)
+		}
+	}
+}
+
+func TestPostForm(t *testing.T) {
+	h := newTestHandler(t, "-s", "1K")
+	form := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	for _, c := range []struct {
+		body   string
+		status int
+		want   string
+	}{
+		{"paste=foo+bar%21", http.StatusOK, "foo bar!"},
+		{"expire=1h&paste=foo", http.StatusOK, "foo"},
+		{"FOO=bar\nBAR=baz\n", http.StatusOK, "FOO=bar\nBAR=baz\n"},
+		{"just some text", http.StatusOK, "just some text"},
+		{"expire=1h", http.StatusOK, "expire=1h"},
+		{"paste=foo&burn=true", http.StatusBadRequest, ""},
+		{"paste=foo%4", http.StatusBadRequest, ""},
+		{"expire=%zz&paste=foo", http.StatusBadRequest, ""},
+		{"expire=soon&paste=foo", http.StatusBadRequest, ""},
+		{"paste=", http.StatusBadRequest, ""},
+		{"paste=" + strings.Repeat("x", 2<<10), http.StatusRequestEntityTooLarge, ""},
+		{strings.Repeat("x", 2<<10), http.StatusRequestEntityTooLarge, ""},
+	} {
+		w := serveBody(h, "POST", "/", form, c.body)
+		what := fmt.Sprintf("POST of %.20q", c.body)
+		wantResponse(t, w, what, c.status, "")
+		if w.Code != http.StatusOK {
+			continue
+		}
+		id := path.Base(strings.TrimSpace(w.Body.String()))
+		wantResponse(t, serve(h, "GET", "/"+id, nil), "GET after "+what, http.StatusOK, c.want)
+	}
+}
+
+func TestPutBody(t *testing.T) {
+	h := newTestHandler(t)
+	w := serveBody(h, "PUT", "/notes.txt", http.Header{"Content-Type": {"text/markdown"}}, "# foo")
+	wantResponse(t, w, "PUT", http.StatusOK, "")
+	id := path.Base(strings.TrimSpace(w.Body.String()))
+	w = serve(h, "GET", "/"+id, nil)
+	wantResponse(t, w, "GET after PUT", http.StatusOK, "# foo")
+	if got, want := w.Header().Get("Content-Disposition"), "inline; filename=notes.txt"; got != want {
+		t.Errorf("GET after PUT got Content-Disposition %q, want %q", got, want)
+	}
+	var info pasteInfo
+	decodeJSON(t, serve(h, "GET", apiPastesPath+"/"+id, nil), &info)
+	if info.Filename != "notes.txt" || info.ContentType != "text/markdown" {
+		t.Errorf("PUT kept file name %q and content type %q", info.Filename, info.ContentType)
+	}
+
+	w = serveBody(h, "PUT", "/", nil, "foo")
+	wantResponse(t, w, "PUT without a file name", http.StatusOK, "")
+	id = path.Base(strings.TrimSpace(w.Body.String()))
+	w = serve(h, "GET", "/"+id, nil)
+	wantResponse(t, w, "GET after PUT without a file name", http.StatusOK, "foo")
+	if got := w.Header().Get("Content-Disposition"); got != "" {
+		t.Errorf("GET after PUT without a file name got Content-Disposition %q", got)
+	}
+}
+
+func TestPostBody(t *testing.T) {
+	h := newTestHandler(t)
+	binary := http.Header{"Content-Type": {"application/octet-stream"}}
+	content := "foo\x00bar&paste=baz\n"
+	w := serveBody(h, "POST", "/", binary, content)
+	wantResponse(t, w, "POST", http.StatusOK, "")
+	id := path.Base(strings.TrimSpace(w.Body.String()))
+	wantResponse(t, serve(h, "GET", "/"+id, nil), "GET after POST", http.StatusOK, content)
+
+	// options in the URL query
+	w = serveBody(h, "POST", "/?burn=true&expire=1h", binary, "foo")
+	wantResponse(t, w, "POST with options in the query", http.StatusOK, "")
+	id = path.Base(strings.TrimSpace(w.Body.String()))
+	var info pasteInfo
+	decodeJSON(t, serve(h, "GET", apiPastesPath+"/"+id, nil), &info)
+	if !info.Burn || info.Expires == nil || time.Until(*info.Expires) > time.Hour {
+		t.Errorf("POST with options in the query got burn %t and expiry %v", info.Burn, info.Expires)
+	}
+
+	// options in headers, with the query taking precedence
+	header := http.Header{
+		"Content-Type": {"application/octet-stream"},
+		"Burn":         {"true"},
+		"Expire":       {"1h"},
+	}
+	w = serveBody(h, "PUT", "/log.txt?expire=30m", header, "foo")
+	wantResponse(t, w, "PUT with options in headers", http.StatusOK, "")
+	id = path.Base(strings.TrimSpace(w.Body.String()))
+	info = pasteInfo{}
+	decodeJSON(t, serve(h, "GET", apiPastesPath+"/"+id, nil), &info)
+	if !info.Burn || info.Expires == nil || time.Until(*info.Expires) > 30*time.Minute {
+		t.Errorf("PUT with options in headers got burn %t and expiry %v", info.Burn, info.Expires)
+	}
+
+	for _, c := range []struct {
+		target string
+		header http.Header
+	}{
+		{"/?expire=soon", nil},
+		{"/", http.Header{"Burn": {"maybe"}}},
+		{"/", http.Header{"Expire": {"-1h"}}},
+	} {
+		w := serveBody(h, "POST", c.target, c.header, "foo")
+		wantResponse(t, w, fmt.Sprintf("POST on %s with %v", c.target, c.header), http.StatusBadRequest, "")
+	}
+}
+
+func TestNames(t *testing.T) {
+	h := newTestHandler(t)
+	w := upload(h, "/", "foo", vanityName, "build.log")
+	wantResponse(t, w, "Upload with a name", http.StatusOK, "http://localhost:8080/~build.log\n")
+	token := w.Header().Get(tokenName)
+	wantResponse(t, serve(h, "GET", "/~build.log", nil), "GET by name", http.StatusOK, "foo")
+	wantResponse(t, serve(h, "GET", "/~BUILD.log", nil), "GET by name in another case", http.StatusNotFound, "")
+
+	w = upload(h, "/", "bar", vanityName, "build.log")
+	wantResponse(t, w, "Upload with a taken name", http.StatusConflict, "")
+	wantResponse(t, serve(h, "GET", "/~build.log", nil), "GET after a taken name", http.StatusOK, "foo")
+	w = serveBody(h, "PUT", "/other.txt", http.Header{"Name": {"build.log"}}, "bar")
+	wantResponse(t, w, "PUT with a taken name", http.StatusConflict, "")
+
+	for _, name := range []string{"ab", ".hidden", "a/b", "a b", "~foo", strings.Repeat("a", 65)} {
+		w := upload(h, "/", "foo", vanityName, name)
+		wantResponse(t, w, fmt.Sprintf("Upload with name %q", name), http.StatusBadRequest, "")
+	}
+
+	w = serve(h, "DELETE", "/~build.log", http.Header{"Delete-Token": {token}})
+	wantResponse(t, w, "DELETE by name", http.StatusOK, "")
+	wantResponse(t, serve(h, "GET", "/~build.log", nil), "GET after deleting", http.StatusNotFound, "")
+	w = upload(h, "/", "bar", vanityName, "build.log")
+	wantResponse(t, w, "Upload with a name free again", http.StatusOK, "")
+	wantResponse(t, serve(h, "GET", "/~build.log", nil), "GET of the new paste", http.StatusOK, "bar")
+}
+
+func TestEncrypted(t *testing.T) {
+	h := newTestHandler(t)
+	mac := strings.Repeat("ab", 32)
+	w := serveBody(h, "POST", "/", http.Header{
+		"Encrypted":     {"true"},
+		secretMACHeader: {mac},
+	}, "U2FsdGVkX1+foo")
+	wantResponse(t, w, "POST of an encrypted paste", http.StatusOK, "")
+	id := path.Base(strings.TrimSpace(w.Body.String()))
+
+	w = serve(h, "GET", "/"+id, nil)
+	wantResponse(t, w, "GET", http.StatusOK, "U2FsdGVkX1+foo")
+	if got := w.Header().Get(encryptedName); got != "true" {
+		t.Errorf("GET got %s header %q, want %q", encryptedName, got, "true")
+	}
+	if got := w.Header().Get(secretMACHeader); got != mac {
+		t.Errorf("GET got %s header %q, want %q", secretMACHeader, got, mac)
+	}
+	var info pasteInfo
+	decodeJSON(t, serve(h, "GET", apiPastesPath+"/"+id, nil), &info)
+	if !info.Encrypted {
+		t.Errorf("GET of the information is not marked as encrypted: %+v", info)
+	}
+	if got := info.Header[http.CanonicalHeaderKey(secretMACHeader)]; got != mac {
+		t.Errorf("GET of the information got %s %q, want %q", secretMACHeader, got, mac)
+	}
+
+	id, _ = mustUpload(t, h, "foo", encryptedName, "true")
+	w = serve(h, "GET", "/"+id, nil)
+	if got := w.Header().Get(encryptedName); got != "true" {
+		t.Errorf("GET after a form upload got %s header %q, want %q", encryptedName, got, "true")
+	}
+	id, _ = mustUpload(t, h, "foo")
+	w = serve(h, "GET", "/"+id, nil)
+	if got := w.Header().Get(encryptedName); got != "" {
+		t.Errorf("GET of a plain paste got %s header %q", encryptedName, got)
+	}
+	info = pasteInfo{}
+	decodeJSON(t, serve(h, "GET", apiPastesPath+"/"+id, nil), &info)
+	if info.Encrypted {
+		t.Errorf("GET of the information of a plain paste is marked as encrypted")
+	}
+	wantResponse(t, upload(h, "/", "foo", encryptedName, "maybe"),
+		"Upload with an invalid encrypted value", http.StatusBadRequest, "")
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Values of the proxy_header setting
+const (
+	// X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host
+	headerXForwarded = "x-forwarded"
+	// Forwarded, as defined in RFC 7239
+	headerForwarded = "forwarded"
+)
+
+// remoteIP returns the address of the host that r was received from.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && conf().trustedProxies.contains(ip)
+}
+
+// forwardedElems returns the elements of the Forwarded header of r as
+// defined in RFC 7239, in the order the proxies added them.
+func forwardedElems(r *http.Request) []map[string]string {
+	var elems []map[string]string
+	for _, line := range r.Header["Forwarded"] {
+		for _, elem := range splitQuoted(line, ',') {
+			params := make(map[string]string)
+			for _, pair := range splitQuoted(elem, ';') {
+				i := strings.Index(pair, "=")
+				if i < 0 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(pair[:i]))
+				params[key] = unquote(strings.TrimSpace(pair[i+1:]))
+			}
+			elems = append(elems, params)
+		}
+	}
+	return elems
+}
+
+// splitQuoted splits s by sep, except within quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped := false, false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote returns the value of a quoted string, or s as is if it is not
+// quoted.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// forwardedValues returns the values of the given parameter in the
+// Forwarded header of r, or in the given X-Forwarded header, in the order
+// the proxies added them. Only the kind of header that the trusted proxies
+// set is read, since they pass the other one along as sent by the client.
+func forwardedValues(r *http.Request, param, header string) []string {
+	var values []string
+	if conf().proxyHeader == headerForwarded {
+		for _, params := range forwardedElems(r) {
+			values = append(values, params[param])
+		}
+		return values
+	}
+	for _, line := range r.Header[header] {
+		for _, v := range strings.Split(line, ",") {
+			values = append(values, strings.TrimSpace(v))
+		}
+	}
+	return values
+}
+
+// nodeAddr returns the address in a node of the Forwarded header or an
+// X-Forwarded-For header, which may have a port and brackets.
+func nodeAddr(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.Trim(node, "[]")
+}
+
+// clientAddr returns the address of the client that sent r. If it was
+// received from a trusted proxy, the nodes in the forwarding headers are
+// followed from the last one back to the first that is not a trusted proxy,
+// since any before it may have been made up by the client.
+func clientAddr(r *http.Request) string {
+	addr := remoteIP(r)
+	if !isTrustedProxy(addr) {
+		return addr
+	}
+	nodes := forwardedValues(r, "for", "X-Forwarded-For")
+	for i := len(nodes) - 1; i >= 0; i-- {
+		next := nodeAddr(nodes[i])
+		if net.ParseIP(next) == nil {
+			// obfuscated or unknown, so we can't go further
+			break
+		}
+		addr = next
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// lastForwarded returns the value of the given forwarding parameter as set
+// by the proxy closest to us, if r was received from a trusted one.
+func lastForwarded(r *http.Request, param, header string) string {
+	if !isTrustedProxy(remoteIP(r)) {
+		return ""
+	}
+	values := forwardedValues(r, param, header)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+// siteURLFor returns the URL of the site as seen by the client that sent
+// r. The scheme and host given by trusted proxies take precedence over
+// the ones in the site URL.
+func siteURLFor(r *http.Request) string {
+	proto := strings.ToLower(lastForwarded(r, "proto", "X-Forwarded-Proto"))
+	host := lastForwarded(r, "host", "X-Forwarded-Host")
+	siteURL := conf().siteURL
+	if proto == "" && host == "" {
+		return siteURL
+	}
+	u, err := url.Parse(siteURL)
+	if err != nil {
+		return siteURL
+	}
+	if proto == "http" || proto == "https" {
+		u.Scheme = proto
+	}
+	if host != "" && !strings.ContainsAny(host, "/\\@?# ") {
+		u.Host = host
+	}
+	return u.String()
+}
+
+func pasteURL(r *http.Request, id storage.ID) string {
+	return fmt.Sprintf("%s/%s", siteURLFor(r), id)
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestForwardedElems(t *testing.T) {
+	for _, c := range []struct {
+		lines []string
+		want  []map[string]string
+	}{
+		{nil, nil},
+		{
+			[]string{"for=192.0.2.60;proto=http;by=203.0.113.43"},
+			[]map[string]string{{"for": "192.0.2.60", "proto": "http", "by": "203.0.113.43"}},
+		},
+		{
+			[]string{"For=192.0.2.43, for=198.51.100.17"},
+			[]map[string]string{{"for": "192.0.2.43"}, {"for": "198.51.100.17"}},
+		},
+		{
+			[]string{"for=192.0.2.43", "for=198.51.100.17"},
+			[]map[string]string{{"for": "192.0.2.43"}, {"for": "198.51.100.17"}},
+		},
+		{
+			[]string{`for="[2001:db8:cafe::17]:4711"`},
+			[]map[string]string{{"for": "[2001:db8:cafe::17]:4711"}},
+		},
+		{
+			[]string{`for=192.0.2.43;host="a,b;c", for=198.51.100.17`},
+			[]map[string]string{{"for": "192.0.2.43", "host": "a,b;c"}, {"for": "198.51.100.17"}},
+		},
+		{
+			[]string{`host="a\"b\\c"`},
+			[]map[string]string{{"host": `a"b\c`}},
+		},
+		{
+			[]string{"for=_hidden ; junk, for=unknown"},
+			[]map[string]string{{"for": "_hidden"}, {"for": "unknown"}},
+		},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header["Forwarded"] = c.lines
+		if got := forwardedElems(r); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("forwardedElems(%q) got %v, want %v", c.lines, got, c.want)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	for _, c := range []struct {
+		proxyHeader string
+		remote      string
+		forwarded   string
+		xff         string
+		want        string
+	}{
+		{headerXForwarded, "192.0.2.1:1234", "", "", "192.0.2.1"},
+		{headerXForwarded, "[2001:db8::1]:1234", "", "", "2001:db8::1"},
+
+		// untrusted peers can't spoof their address
+		{headerXForwarded, "192.0.2.1:1234", "", "203.0.113.5", "192.0.2.1"},
+		{headerForwarded, "192.0.2.1:1234", "for=203.0.113.5", "", "192.0.2.1"},
+		{headerForwarded, "192.0.2.1:1234", "for=203.0.113.5", "203.0.113.6", "192.0.2.1"},
+
+		// a trusted proxy in front
+		{headerXForwarded, "10.0.0.1:1234", "", "203.0.113.5", "203.0.113.5"},
+		{headerForwarded, "10.0.0.1:1234", "for=203.0.113.5", "", "203.0.113.5"},
+		{headerXForwarded, "[::1]:1234", "", "203.0.113.5", "203.0.113.5"},
+		{headerXForwarded, "10.0.0.1:1234", "", "", "10.0.0.1"},
+
+		// the header that the proxy does not set is passed along as
+		// sent by the client, so it is ignored
+		{headerXForwarded, "10.0.0.1:1234", "for=198.51.100.1", "203.0.113.5", "203.0.113.5"},
+		{headerXForwarded, "10.0.0.1:1234", "for=198.51.100.1", "", "10.0.0.1"},
+		{headerForwarded, "10.0.0.1:1234", "for=203.0.113.5", "198.51.100.1", "203.0.113.5"},
+		{headerForwarded, "10.0.0.1:1234", "", "198.51.100.1", "10.0.0.1"},
+
+		// IPv6 and ports
+		{headerForwarded, "10.0.0.1:1234", `for="[2001:db8:cafe::17]:4711"`, "", "2001:db8:cafe::17"},
+		{headerForwarded, "10.0.0.1:1234", `for="[2001:db8:cafe::17]"`, "", "2001:db8:cafe::17"},
+		{headerForwarded, "10.0.0.1:1234", `for="203.0.113.5:4711"`, "", "203.0.113.5"},
+		{headerXForwarded, "10.0.0.1:1234", "", "[2001:db8::2]:80", "2001:db8::2"},
+		{headerXForwarded, "10.0.0.1:1234", "", "2001:db8::2", "2001:db8::2"},
+
+		// multiple hops, where the client may have spoofed the first ones
+		{headerXForwarded, "10.0.0.1:1234", "", "198.51.100.1, 203.0.113.5, 10.0.0.2", "203.0.113.5"},
+		{headerForwarded, "10.0.0.1:1234", "for=198.51.100.1, for=203.0.113.5;proto=https, for=10.0.0.2", "", "203.0.113.5"},
+		{headerXForwarded, "10.0.0.1:1234", "", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+
+		// unknown or obfuscated nodes stop the search
+		{headerForwarded, "10.0.0.1:1234", "for=203.0.113.5, for=_hidden", "", "10.0.0.1"},
+		{headerForwarded, "10.0.0.1:1234", "for=203.0.113.5, for=unknown, for=10.0.0.2", "", "10.0.0.2"},
+		{headerXForwarded, "10.0.0.1:1234", "", "garbage", "10.0.0.1"},
+	} {
+		setConf(t, "-P", "10.0.0.0/8,::1", "-F", c.proxyHeader)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("Forwarded", c.forwarded)
+		}
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if got := clientAddr(r); got != c.want {
+			t.Errorf("clientAddr with %s from %s with %q and %q got %s, want %s",
+				c.proxyHeader, c.remote, c.forwarded, c.xff, got, c.want)
+		}
+	}
+}
+
+func TestSiteURLFor(t *testing.T) {
+	for _, c := range []struct {
+		proxyHeader string
+		remote      string
+		header      map[string]string
+		want        string
+	}{
+		{headerXForwarded, "10.0.0.1:1234", nil, "http://my.site"},
+		{headerXForwarded, "10.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "https"}, "https://my.site"},
+		{headerXForwarded, "10.0.0.1:1234", map[string]string{"X-Forwarded-Host": "other.site"}, "http://other.site"},
+		{headerForwarded, "10.0.0.1:1234", map[string]string{"Forwarded": `proto=HTTPS;host="other.site:8080"`}, "https://other.site:8080"},
+		{headerForwarded, "10.0.0.1:1234", map[string]string{"Forwarded": "host=a.site, host=b.site"}, "http://b.site"},
+		{headerXForwarded, "10.0.0.1:1234", map[string]string{"Forwarded": "host=evil.site"}, "http://my.site"},
+		{headerForwarded, "10.0.0.1:1234", map[string]string{"X-Forwarded-Host": "evil.site"}, "http://my.site"},
+		{headerXForwarded, "10.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "ftp"}, "http://my.site"},
+		{headerXForwarded, "10.0.0.1:1234", map[string]string{"X-Forwarded-Host": "evil.site/path"}, "http://my.site"},
+		{headerXForwarded, "10.0.0.1:1234", map[string]string{"X-Forwarded-Host": "user@evil.site"}, "http://my.site"},
+		{headerXForwarded, "192.0.2.1:1234", map[string]string{"X-Forwarded-Proto": "https"}, "http://my.site"},
+		{headerForwarded, "192.0.2.1:1234", map[string]string{"Forwarded": "host=evil.site"}, "http://my.site"},
+	} {
+		setConf(t, "-u", "http://my.site", "-P", "10.0.0.1", "-F", c.proxyHeader)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		for name, value := range c.header {
+			r.Header.Set(name, value)
+		}
+		if got := siteURLFor(r); got != c.want {
+			t.Errorf("siteURLFor with %s from %s with %v got %s, want %s",
+				c.proxyHeader, c.remote, c.header, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of slots the window of the upload quota is split into
+	quotaSlots = 60
+	// Shortest window of the upload quota, so that each slot lasts at
+	// least a second
+	minQuotaWindow = quotaSlots * time.Second
+	// Forget about idle clients how often
+	cleanupInterval = 1 * time.Minute
+	// Passwords hashed at once per client
+	clientHashes = 2
+	// How long to wait for a password to be hashed when all the CPUs are
+	// busy doing so already
+	hashWait = 2 * time.Second
+
+	// HTTP response strings
+	rateLimited   = "too many uploads, try again later"
+	quotaExceeded = "upload quota exceeded, try again later"
+	tooManyHashes = "too many passwords being checked, try again later"
+)
+
+var (
+	errRateLimited   = errors.New(rateLimited)
+	errQuotaExceeded = errors.New(quotaExceeded)
+	errTooManyHashes = errors.New(tooManyHashes)
+)
+
+// netList is a list of networks that can be given as a comma-separated
+// flag. Single addresses are taken as networks of their own.
+type netList []*net.IPNet
+
+func (l *netList) String() string {
+	var s []string
+	for _, n := range *l {
+		s = append(s, n.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *netList) Set(value string) error {
+	var nets netList
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("invalid address '%s'", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid network '%s'", s)
+		}
+		nets = append(nets, n)
+	}
+	*l = nets
+	return nil
+}
+
+func (l netList) contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixLengths holds the lengths of the IPv4 and IPv6 prefixes that
+// clients are grouped by
+type prefixLengths struct {
+	v4, v6 int
+}
+
+func (p *prefixLengths) String() string {
+	return fmt.Sprintf("%d,%d", p.v4, p.v6)
+}
+
+func (p *prefixLengths) Set(value string) error {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid prefix lengths '%s'", value)
+	}
+	v4, err4 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	v6, err6 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err4 != nil || err6 != nil || v4 < 0 || v4 > 32 || v6 < 0 || v6 > 128 {
+		return fmt.Errorf("invalid prefix lengths '%s'", value)
+	}
+	p.v4, p.v6 = v4, v6
+	return nil
+}
+
+// limiter limits how often and how many bytes each client can upload. The
+// rate is enforced via token buckets, and the bytes via a quota over a
+// rolling window.
+type limiter struct {
+	sync.Mutex
+	// uploads allowed per second, and at once
+	rate  float64
+	burst float64
+	// bytes allowed within window, if any
+	quota  int64
+	window time.Duration
+
+	prefix  prefixLengths
+	exempt  netList
+	clients map[string]*clientLimit
+}
+
+// clientLimit holds the state of the limits of a client
+type clientLimit struct {
+	tokens float64
+	filled time.Time
+	// bytes uploaded per slot of the window, as a ring
+	usage [quotaSlots]int64
+	// index of the latest slot in usage
+	slot int64
+}
+
+func newLimiter(perMinute float64, burst int, quota int64, window time.Duration,
+	prefix prefixLengths, exempt netList) *limiter {
+	l := &limiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		quota:   quota,
+		window:  window,
+		prefix:  prefix,
+		exempt:  exempt,
+		clients: make(map[string]*clientLimit),
+	}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	go l.run()
+	return l
+}
+
+// key returns the key of the client that sent r, or false if the client is
+// exempt from the limits.
+func (l *limiter) key(r *http.Request) (string, bool) {
+	addr := clientAddr(r)
+	if ip := net.ParseIP(addr); ip != nil && l.exempt.contains(ip) {
+		return "", false
+	}
+	return clientKey(addr, l.prefix), true
+}
+
+// clientKey returns the key that the client at addr is known by, which is
+// the network of the given prefix length that it belongs to.
+func clientKey(addr string, prefix prefixLengths) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(prefix.v4, 8*net.IPv4len)).String()
+	}
+	return ip.Mask(net.CIDRMask(prefix.v6, 8*net.IPv6len)).String()
+}
+
+func (l *limiter) slotLen() time.Duration {
+	return l.window / quotaSlots
+}
+
+// client returns the state of the client known by key, creating it if
+// needed and bringing it up to date with now.
+func (l *limiter) client(key string, now time.Time) *clientLimit {
+	c, e := l.clients[key]
+	if !e {
+		c = &clientLimit{tokens: l.burst, filled: now}
+		l.clients[key] = c
+	}
+	if l.rate > 0 {
+		c.tokens += now.Sub(c.filled).Seconds() * l.rate
+		if c.tokens > l.burst {
+			c.tokens = l.burst
+		}
+	}
+	c.filled = now
+	if l.quota > 0 {
+		slot := now.UnixNano() / int64(l.slotLen())
+		if slot-c.slot >= quotaSlots {
+			c.usage = [quotaSlots]int64{}
+		} else {
+			for i := c.slot + 1; i <= slot; i++ {
+				c.usage[i%quotaSlots] = 0
+			}
+		}
+		c.slot = slot
+	}
+	return c
+}
+
+func (c *clientLimit) used() int64 {
+	var n int64
+	for _, u := range c.usage {
+		n += u
+	}
+	return n
+}
+
+// quotaRetry returns how long it will take for some of the quota of c to be
+// freed.
+func (l *limiter) quotaRetry(c *clientLimit, now time.Time) time.Duration {
+	for i := c.slot - quotaSlots + 1; i <= c.slot; i++ {
+		if c.usage[i%quotaSlots] > 0 {
+			freed := time.Unix(0, (i+quotaSlots)*int64(l.slotLen()))
+			return freed.Sub(now)
+		}
+	}
+	return 0
+}
+
+// take takes an upload from the client known by key. If it is not allowed,
+// it returns how long to wait before trying again along with the error.
+func (l *limiter) take(key string, now time.Time) (time.Duration, error) {
+	l.Lock()
+	defer l.Unlock()
+	c := l.client(key, now)
+	if l.quota > 0 && c.used() >= l.quota {
+		return l.quotaRetry(c, now), errQuotaExceeded
+	}
+	if l.rate > 0 {
+		if c.tokens < 1 {
+			wait := time.Duration((1 - c.tokens) / l.rate * float64(time.Second))
+			return wait, errRateLimited
+		}
+		c.tokens--
+	}
+	return 0, nil
+}
+
+// record accounts for n bytes uploaded by the client known by key. If the
+// quota is exceeded as a result, it returns how long to wait before trying
+// again along with the error.
+func (l *limiter) record(key string, n int64, now time.Time) (time.Duration, error) {
+	l.Lock()
+	defer l.Unlock()
+	c := l.client(key, now)
+	c.usage[c.slot%quotaSlots] += n
+	if c.used() > l.quota {
+		return l.quotaRetry(c, now), errQuotaExceeded
+	}
+	return 0, nil
+}
+
+func (l *limiter) run() {
+	for now := range time.Tick(cleanupInterval) {
+		l.cleanup(now)
+	}
+}
+
+// cleanup forgets about the clients whose limits are back to how they
+// started, so that they don't take up memory.
+func (l *limiter) cleanup(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	for key := range l.clients {
+		c := l.client(key, now)
+		if c.tokens >= l.burst && c.used() == 0 {
+			delete(l.clients, key)
+		}
+	}
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	secs := int64((wait + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+}
+
+// admit takes an upload from the client that sent r. It returns a function
+// to wrap the content of the upload with, so that its bytes are accounted
+// for in the quota of the client. If the upload is not allowed, it sets the
+// Retry-After header in w and returns the error.
+func (l *limiter) admit(w http.ResponseWriter, r *http.Request) (func(io.Reader) io.Reader, error) {
+	noop := func(r io.Reader) io.Reader { return r }
+	if l == nil {
+		return noop, nil
+	}
+	key, limited := l.key(r)
+	if !limited {
+		return noop, nil
+	}
+	if wait, err := l.take(key, time.Now()); err != nil {
+		setRetryAfter(w, wait)
+		return nil, err
+	}
+	if l.quota == 0 {
+		return noop, nil
+	}
+	return func(r io.Reader) io.Reader {
+		return &quotaReader{r: r, l: l, key: key, w: w}
+	}, nil
+}
+
+// quotaReader accounts for the bytes of an upload read through it, failing
+// once the quota of its client is exceeded
+type quotaReader struct {
+	r   io.Reader
+	l   *limiter
+	key string
+	w   http.ResponseWriter
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	n, err := qr.r.Read(p)
+	if n > 0 {
+		if wait, qerr := qr.l.record(qr.key, int64(n), time.Now()); qerr != nil {
+			setRetryAfter(qr.w, wait)
+			return n, qerr
+		}
+	}
+	return n, err
+}
+
+// hashLimiter limits the passwords hashed at once, as each one takes a
+// while on purpose. Each client can only have a few of them hashed at once,
+// so that it cannot take up all of them, and the rest wait for a while for
+// one to be free instead of failing right away.
+type hashLimiter struct {
+	sync.Mutex
+	slots   chan struct{}
+	wait    time.Duration
+	clients map[string]int
+}
+
+func newHashLimiter(slots int, wait time.Duration) *hashLimiter {
+	return &hashLimiter{
+		slots:   make(chan struct{}, slots),
+		wait:    wait,
+		clients: make(map[string]int),
+	}
+}
+
+// begin waits for a password to be hashed for the client that sent r,
+// returning the func to call once done. If the client is hashing too many
+// already, or none is free in time, it sets the Retry-After header in w and
+// returns the error.
+func (hl *hashLimiter) begin(w http.ResponseWriter, r *http.Request) (func(), error) {
+	key := clientKey(clientAddr(r), conf().clientPrefix)
+	hl.Lock()
+	if hl.clients[key] >= clientHashes {
+		hl.Unlock()
+		setRetryAfter(w, time.Second)
+		return nil, errTooManyHashes
+	}
+	hl.clients[key]++
+	hl.Unlock()
+	release := func() {
+		hl.Lock()
+		defer hl.Unlock()
+		if hl.clients[key]--; hl.clients[key] == 0 {
+			delete(hl.clients, key)
+		}
+	}
+	timer := time.NewTimer(hl.wait)
+	defer timer.Stop()
+	select {
+	case hl.slots <- struct{}{}:
+		return func() {
+			<-hl.slots
+			release()
+		}, nil
+	case <-timer.C:
+		release()
+		setRetryAfter(w, time.Second)
+		return nil, errTooManyHashes
+	case <-r.Context().Done():
+		release()
+		return nil, r.Context().Err()
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setConf makes the configuration given by args the one in use.
+func setConf(t *testing.T, args ...string) {
+	t.Helper()
+	c, err := loadConfig(args, nil)
+	if err != nil {
+		t.Fatalf("loadConfig(%q) errored unexpectedly: %v", args, err)
+	}
+	current.Store(c)
+}
+
+func TestNetListSet(t *testing.T) {
+	for _, c := range []struct {
+		value   string
+		in, out []string
+		wantErr bool
+	}{
+		{"", nil, []string{"10.0.0.1", "::1"}, false},
+		{"10.0.0.1", []string{"10.0.0.1"}, []string{"10.0.0.2", "::1"}, false},
+		{" 10.0.0.0/8 , ::1 ", []string{"10.1.2.3", "::1"}, []string{"11.0.0.1", "::2"}, false},
+		{"2001:db8::/32", []string{"2001:db8::1"}, []string{"2001:db9::1", "10.0.0.1"}, false},
+		{"10.0.0.1,", []string{"10.0.0.1"}, nil, false},
+		{"foo", nil, nil, true},
+		{"10.0.0.0/33", nil, nil, true},
+	} {
+		var l netList
+		err := l.Set(c.value)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("Set(%q) did not error as expected", c.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q) errored unexpectedly: %v", c.value, err)
+			continue
+		}
+		for _, addr := range c.in {
+			if !l.contains(net.ParseIP(addr)) {
+				t.Errorf("Set(%q) does not contain %s", c.value, addr)
+			}
+		}
+		for _, addr := range c.out {
+			if l.contains(net.ParseIP(addr)) {
+				t.Errorf("Set(%q) contains %s unexpectedly", c.value, addr)
+			}
+		}
+	}
+}
+
+func TestPrefixLengthsSet(t *testing.T) {
+	for _, c := range []struct {
+		value   string
+		want    prefixLengths
+		wantErr bool
+	}{
+		{"32,128", prefixLengths{32, 128}, false},
+		{" 24 , 64 ", prefixLengths{24, 64}, false},
+		{"0,0", prefixLengths{0, 0}, false},
+		{"24", prefixLengths{}, true},
+		{"24,64,8", prefixLengths{}, true},
+		{"33,64", prefixLengths{}, true},
+		{"24,129", prefixLengths{}, true},
+		{"-1,64", prefixLengths{}, true},
+		{"a,b", prefixLengths{}, true},
+	} {
+		var p prefixLengths
+		err := p.Set(c.value)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("Set(%q) did not error as expected", c.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q) errored unexpectedly: %v", c.value, err)
+		} else if p != c.want {
+			t.Errorf("Set(%q) got %v, want %v", c.value, p, c.want)
+		}
+	}
+}
+
+func TestLimiterKey(t *testing.T) {
+	setConf(t)
+	var exempt netList
+	if err := exempt.Set("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	l := newLimiter(1, 1, 0, 0, prefixLengths{24, 64}, exempt)
+	for _, c := range []struct {
+		remote      string
+		want        string
+		wantLimited bool
+	}{
+		{"192.0.2.33:1234", "192.0.2.0", true},
+		{"192.0.2.200:1234", "192.0.2.0", true},
+		{"192.0.3.1:1234", "192.0.3.0", true},
+		{"[2001:db8:1:2:3::1]:80", "2001:db8:1:2::", true},
+		{"[::ffff:192.0.2.33]:80", "192.0.2.0", true},
+		{"10.1.2.3:1234", "", false},
+		{"@", "@", true},
+	} {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = c.remote
+		got, limited := l.key(r)
+		if got != c.want || limited != c.wantLimited {
+			t.Errorf("key(%s) got %q, %t, want %q, %t", c.remote,
+				got, limited, c.want, c.wantLimited)
+		}
+	}
+}
+
+func TestLimiterTake(t *testing.T) {
+	type step struct {
+		// time since the start of the test
+		at time.Duration
+		// bytes to record instead of taking an upload, if any
+		record   int64
+		wantWait time.Duration
+		wantErr  error
+	}
+	for i, c := range []struct {
+		perMinute float64
+		burst     int
+		quota     int64
+		window    time.Duration
+		steps     []step
+	}{
+		{
+			perMinute: 60, burst: 2,
+			steps: []step{
+				{at: 0},
+				{at: 0},
+				{at: 0, wantWait: time.Second, wantErr: errRateLimited},
+				{at: 500 * time.Millisecond, wantWait: 500 * time.Millisecond, wantErr: errRateLimited},
+				{at: time.Second},
+				{at: 5 * time.Second},
+				{at: 5 * time.Second},
+				{at: 5 * time.Second, wantWait: time.Second, wantErr: errRateLimited},
+			},
+		},
+		{
+			perMinute: 0, burst: 1,
+			steps: []step{
+				{at: 0},
+				{at: 0},
+				{at: 0},
+			},
+		},
+		{
+			quota: 100, window: time.Minute, burst: 1,
+			steps: []step{
+				{at: 0},
+				{at: 0, record: 60},
+				{at: 10 * time.Second},
+				{at: 10 * time.Second, record: 50, wantWait: 50 * time.Second, wantErr: errQuotaExceeded},
+				{at: 30 * time.Second, wantWait: 30 * time.Second, wantErr: errQuotaExceeded},
+				{at: 60 * time.Second},
+				{at: 60 * time.Second, record: 50},
+				{at: 61 * time.Second, wantWait: 9 * time.Second, wantErr: errQuotaExceeded},
+				{at: 10 * time.Minute},
+			},
+		},
+	} {
+		l := newLimiter(c.perMinute, c.burst, c.quota, c.window, prefixLengths{32, 128}, nil)
+		// aligned with the slots of the quota window
+		start := time.Unix(1000000, 0)
+		for j, s := range c.steps {
+			var wait time.Duration
+			var err error
+			if s.record > 0 {
+				wait, err = l.record("client", s.record, start.Add(s.at))
+			} else {
+				wait, err = l.take("client", start.Add(s.at))
+			}
+			if err != s.wantErr || wait != s.wantWait {
+				t.Errorf("case %d step %d got %s, %v, want %s, %v",
+					i, j, wait, err, s.wantWait, s.wantErr)
+			}
+		}
+		l.cleanup(start.Add(time.Hour))
+		if len(l.clients) != 0 {
+			t.Errorf("case %d still has %d clients after cleanup", i, len(l.clients))
+		}
+	}
+}
+
+func TestLimiterAdmit(t *testing.T) {
+	setConf(t)
+	l := newLimiter(1, 1, 10, time.Minute, prefixLengths{32, 128}, nil)
+	r := httptest.NewRequest("POST", "/", nil)
+	w := httptest.NewRecorder()
+	quota, err := l.admit(w, r)
+	if err != nil {
+		t.Fatalf("admit errored unexpectedly: %v", err)
+	}
+	content := quota(strings.NewReader(strings.Repeat("a", 20)))
+	if _, err := ioutil.ReadAll(content); err != errQuotaExceeded {
+		t.Errorf("reading over the quota got error %v, want %v", err, errQuotaExceeded)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("reading over the quota did not set Retry-After")
+	}
+
+	w = httptest.NewRecorder()
+	if _, err := l.admit(w, r); err != errQuotaExceeded {
+		t.Errorf("admit over the quota got error %v, want %v", err, errQuotaExceeded)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("admit over the quota got Retry-After %q, want %q", got, "60")
+	}
+
+	var nilLimiter *limiter
+	quota, err = nilLimiter.admit(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("admit without limits errored unexpectedly: %v", err)
+	}
+	if _, err := ioutil.ReadAll(quota(strings.NewReader("foo"))); err != nil {
+		t.Errorf("reading without limits errored unexpectedly: %v", err)
+	}
+}
+
+func TestQuotaWindow(t *testing.T) {
+	for _, c := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{[]string{"-w", "1s"}, false},
+		{[]string{"-q", "1M", "-w", "1m"}, false},
+		{[]string{"-q", "1M", "-w", "59s"}, true},
+		{[]string{"-q", "1M", "-w", "60ns"}, true},
+	} {
+		_, err := loadConfig(c.args, nil)
+		if c.wantErr && err == nil {
+			t.Errorf("loadConfig(%q) did not error as expected", c.args)
+		} else if !c.wantErr && err != nil {
+			t.Errorf("loadConfig(%q) errored unexpectedly: %v", c.args, err)
+		}
+	}
+}
+
+func TestHashLimiter(t *testing.T) {
+	setConf(t, "-p", "24,64")
+	hl := newHashLimiter(3, 10*time.Millisecond)
+	request := func(addr string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr + ":1234"
+		return r
+	}
+	begin := func(addr string, wantErr bool) func() {
+		t.Helper()
+		w := httptest.NewRecorder()
+		done, err := hl.begin(w, request(addr))
+		switch {
+		case wantErr && err != errTooManyHashes:
+			t.Fatalf("begin from %s got error %v, want %v", addr, err, errTooManyHashes)
+		case wantErr && w.Header().Get("Retry-After") == "":
+			t.Errorf("begin from %s did not set Retry-After", addr)
+		case !wantErr && err != nil:
+			t.Fatalf("begin from %s errored unexpectedly: %v", addr, err)
+		}
+		return done
+	}
+	done1 := begin("192.0.2.1", false)
+	done2 := begin("192.0.2.2", false)
+	// a client cannot take up all of them
+	begin("192.0.2.3", true)
+	done3 := begin("198.51.100.1", false)
+	// nor can the rest wait forever
+	begin("203.0.113.1", true)
+
+	done1()
+	done4 := begin("203.0.113.1", false)
+	begin("192.0.2.3", true)
+	done2()
+	done5 := begin("192.0.2.3", false)
+	for _, done := range []func(){done3, done4, done5} {
+		done()
+	}
+	if len(hl.clients) != 0 {
+		t.Errorf("hashLimiter still has %d clients after they are done", len(hl.clients))
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Content coding of the content kept by a CompressStore
+	gzipEncoding = "gzip"
+	// Size of the chunks of content that are compressed on their own, so
+	// that any of them can be read without decompressing the ones before
+	compressChunkSize = 64 << 10
+)
+
+// Header of the gzip streams written by a CompressStore, with no name nor
+// modification time so that the same content is always kept the same
+var gzipHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+
+// An EncodedPaste keeps its content encoded, and can give it as kept
+type EncodedPaste interface {
+	Paste
+
+	// Encoding returns the content coding the content is kept in, as
+	// used in the Content-Encoding header.
+	Encoding() string
+
+	// Encoded returns the content as kept, along with its size.
+	Encoded() (io.ReadSeeker, int64)
+}
+
+// CompressStore wraps a store to keep the content of pastes compressed with
+// gzip, so that it can be served as is. The deflate stream starts afresh at
+// each chunk of the content, and the offsets of the chunks are kept in the
+// metadata, so that any part of it can be read by decompressing a single
+// chunk. The wrapped store accounts for the compressed bytes, and the
+// CompressStore for the bytes of each paste once decompressed.
+type CompressStore struct {
+	wrapper
+}
+
+type CompressPaste struct {
+	sync.Mutex
+	raw  Paste
+	meta Metadata
+	size int64
+	// offsets of the chunks in raw
+	chunks []int64
+	// offset to read from next
+	off int64
+
+	fr io.ReadCloser
+	// last chunk decompressed, if any
+	chunk    []byte
+	chunkNum int
+}
+
+func (p *CompressPaste) Read(b []byte) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	n, err := p.readAt(b, p.off)
+	p.off += int64(n)
+	return n, err
+}
+
+func (p *CompressPaste) ReadAt(b []byte, off int64) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	return p.readAt(b, off)
+}
+
+func (p *CompressPaste) readAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(b) && off < p.size {
+		num := int(off / compressChunkSize)
+		chunk, err := p.readChunk(num)
+		if err != nil {
+			return n, err
+		}
+		c := copy(b[n:], chunk[off-int64(num)*compressChunkSize:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readChunk returns the decompressed content of the chunk with the given
+// number.
+func (p *CompressPaste) readChunk(num int) ([]byte, error) {
+	if p.chunk != nil && p.chunkNum == num {
+		return p.chunk, nil
+	}
+	if num >= len(p.chunks) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	start, end := p.chunks[num], p.raw.Size()
+	if num+1 < len(p.chunks) {
+		end = p.chunks[num+1]
+	}
+	want := p.size - int64(num)*compressChunkSize
+	if want > compressChunkSize {
+		want = compressChunkSize
+	}
+	sr := io.NewSectionReader(p.raw, start, end-start)
+	if p.fr == nil {
+		p.fr = flate.NewReader(sr)
+	} else if err := p.fr.(flate.Resetter).Reset(sr, nil); err != nil {
+		return nil, err
+	}
+	if cap(p.chunk) < compressChunkSize {
+		p.chunk = make([]byte, compressChunkSize)
+	}
+	p.chunk = p.chunk[:want]
+	if _, err := io.ReadFull(p.fr, p.chunk); err != nil {
+		p.chunk = nil
+		return nil, err
+	}
+	p.chunkNum = num
+	return p.chunk, nil
+}
+
+func (p *CompressPaste) Seek(offset int64, whence int) (int64, error) {
+	p.Lock()
+	defer p.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += p.off
+	case io.SeekEnd:
+		offset += p.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	p.off = offset
+	return offset, nil
+}
+
+func (p *CompressPaste) Close() error { return p.raw.Close() }
+
+func (p *CompressPaste) ModTime() time.Time { return p.raw.ModTime() }
+
+func (p *CompressPaste) Size() int64 { return p.size }
+
+func (p *CompressPaste) Metadata() Metadata { return p.meta }
+
+func (p *CompressPaste) Encoding() string { return gzipEncoding }
+
+func (p *CompressPaste) Encoded() (io.ReadSeeker, int64) {
+	size := p.raw.Size()
+	return io.NewSectionReader(p.raw, 0, size), size
+}
+
+// decodedMeta returns meta without the fields about how its content is
+// kept.
+func decodedMeta(meta Metadata) Metadata {
+	meta.Encoding, meta.DecodedSize, meta.Chunks = "", 0, nil
+	return meta
+}
+
+// NewCompressStore returns a store keeping its content in inner, recovering
+// any pastes that it already holds. Pastes put in inner directly are kept
+// uncompressed, and the ones left without the offsets of their chunks are
+// deleted, as they were never fully put.
+func NewCompressStore(inner Lister, stats *Stats, expirer *Expirer) (*CompressStore, error) {
+	s := &CompressStore{}
+	s.init(s, inner, stats, expirer)
+	ids, err := inner.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		p, err := inner.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		meta := p.Metadata()
+		size := p.Size()
+		p.Close()
+		if meta.Encoding == gzipEncoding {
+			if meta.Chunks == nil {
+				if err := inner.Delete(id); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			size = meta.DecodedSize
+		}
+		if err := s.recovered(id, size, meta.Expires); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// compressReader compresses what it reads from r into a gzip stream, one
+// chunk at a time
+type compressReader struct {
+	r     io.Reader
+	fw    *flate.Writer
+	crc   uint32
+	chunk []byte
+	// compressed bytes not read yet
+	buf bytes.Buffer
+	err error
+
+	// offsets of the chunks compressed so far
+	chunks []int64
+	// bytes compressed so far, and their size once compressed
+	size, compressed int64
+}
+
+func newCompressReader(r io.Reader) *compressReader {
+	cr := &compressReader{r: r, chunk: make([]byte, compressChunkSize)}
+	cr.fw, _ = flate.NewWriter(&cr.buf, flate.DefaultCompression)
+	return cr
+}
+
+func (cr *compressReader) Read(p []byte) (int, error) {
+	for cr.buf.Len() == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		cr.fill()
+	}
+	return cr.buf.Read(p)
+}
+
+// fill compresses the next chunk into buf, finishing the stream after the
+// last one.
+func (cr *compressReader) fill() {
+	n, err := io.ReadFull(cr.r, cr.chunk)
+	if n > 0 {
+		if cr.size == 0 {
+			cr.buf.Write(gzipHeader)
+		}
+		cr.chunks = append(cr.chunks, cr.compressed+int64(cr.buf.Len()))
+		// no references to the chunks before, and byte-aligned
+		cr.fw.Reset(&cr.buf)
+		cr.fw.Write(cr.chunk[:n])
+		cr.fw.Flush()
+		cr.crc = crc32.Update(cr.crc, crc32.IEEETable, cr.chunk[:n])
+		cr.size += int64(n)
+	}
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		if cr.size > 0 {
+			cr.fw.Close()
+			var trailer [8]byte
+			binary.LittleEndian.PutUint32(trailer[:4], cr.crc)
+			binary.LittleEndian.PutUint32(trailer[4:], uint32(cr.size))
+			cr.buf.Write(trailer[:])
+		}
+		cr.err = io.EOF
+	default:
+		cr.err = err
+	}
+	cr.compressed += int64(cr.buf.Len())
+}
+
+func (s *CompressStore) Get(id ID) (Paste, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	if _, e := s.sizes[id]; !e {
+		return nil, ErrPasteNotFound
+	}
+	p, err := s.inner.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	meta := p.Metadata()
+	if meta.Encoding != gzipEncoding {
+		return p, nil
+	}
+	return &CompressPaste{
+		raw:    p,
+		meta:   decodedMeta(meta),
+		size:   meta.DecodedSize,
+		chunks: meta.Chunks,
+	}, nil
+}
+
+func (s *CompressStore) Put(r io.Reader, meta Metadata) (ID, error) {
+	return s.put("", r, meta)
+}
+
+func (s *CompressStore) PutNamed(id ID, r io.Reader, meta Metadata) error {
+	if !id.Named() {
+		return errNotNamed
+	}
+	_, err := s.put(id, r, meta)
+	return err
+}
+
+// put puts a new paste in the wrapped store under id, or under a random ID
+// if it is empty. The offsets of the chunks are only known once the content
+// has been put, so they are added to the metadata afterwards.
+func (s *CompressStore) put(id ID, r io.Reader, meta Metadata) (ID, error) {
+	return s.wrapper.put(id, r, meta, func(id ID, r io.Reader) (ID, error) {
+		cr := newCompressReader(r)
+		kept := meta
+		kept.Encoding = gzipEncoding
+		id, err := putIn(s.inner, id, cr, kept)
+		if err != nil {
+			return "", err
+		}
+		err = s.inner.Update(id, func(m *Metadata) {
+			m.DecodedSize, m.Chunks = cr.size, cr.chunks
+		})
+		if err != nil {
+			s.inner.Delete(id)
+			return "", err
+		}
+		return id, nil
+	}, nil)
+}
+
+func (s *CompressStore) Update(id ID, f func(*Metadata)) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if _, e := s.sizes[id]; !e {
+		return ErrPasteNotFound
+	}
+	return s.inner.Update(id, func(m *Metadata) {
+		kept := *m
+		*m = decodedMeta(kept)
+		f(m)
+		m.Encoding, m.DecodedSize, m.Chunks = kept.Encoding, kept.DecodedSize, kept.Chunks
+	})
+}
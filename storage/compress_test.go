@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func compressContent() []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 3*compressChunkSize; i++ {
+		fmt.Fprintf(&buf, "line %d of a long log\n", i)
+	}
+	return buf.Bytes()
+}
+
+func TestCompress(t *testing.T) {
+	physical := &Stats{}
+	inner, err := NewMemStore(physical, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logical := &Stats{}
+	s, err := NewCompressStore(inner, logical, NewExpirer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := compressContent()
+	id, err := s.Put(bytes.NewReader(content), Metadata{})
+	if err != nil {
+		t.Fatalf("Put errored unexpectedly: %v", err)
+	}
+	_, size := logical.Report()
+	_, compressed := physical.Report()
+	if size != int64(len(content)) || compressed >= size/2 {
+		t.Errorf("Stats got %d bytes compressed into %d", size, compressed)
+	}
+
+	p, err := s.Get(id)
+	if err != nil {
+		t.Fatalf("Get errored unexpectedly: %v", err)
+	}
+	defer p.Close()
+	// across the end of the first chunk
+	off := int64(compressChunkSize - 10)
+	buf := make([]byte, 20)
+	if n, err := p.ReadAt(buf, off); err != nil || !bytes.Equal(buf[:n], content[off:off+20]) {
+		t.Errorf("ReadAt(%d) got %q and error %v", off, buf[:n], err)
+	}
+	if n, err := p.ReadAt(buf, int64(len(content)-5)); err != io.EOF || n != 5 {
+		t.Errorf("ReadAt past the end got %d bytes and error %v", n, err)
+	}
+	ep, ok := p.(EncodedPaste)
+	if !ok {
+		t.Fatalf("Paste %T does not keep its content encoded", p)
+	}
+	r, encSize := ep.Encoded()
+	if encSize != compressed {
+		t.Errorf("Encoded content got size %d, want %d", encSize, compressed)
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("Encoded content is not gzip: %v", err)
+	}
+	// some clients only read the first member
+	zr.Multistream(false)
+	if got, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("Decompressing the encoded content got %d bytes and error %v", len(got), err)
+	}
+}
+
+func TestCompressRecoverUnfinished(t *testing.T) {
+	inner, err := NewMemStore(&Stats{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewCompressStore(inner, &Stats{}, NewExpirer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := s.Put(bytes.NewReader(compressContent()), Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as if it crashed before the chunks were recorded
+	unfinished, err := s.Put(bytes.NewReader(compressContent()), Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner.Update(unfinished, func(m *Metadata) { m.Chunks = nil })
+	stats := &Stats{}
+	if s, err = NewCompressStore(inner, stats, NewExpirer()); err != nil {
+		t.Fatalf("NewCompressStore errored unexpectedly: %v", err)
+	}
+	if _, err := s.Get(unfinished); err != ErrPasteNotFound {
+		t.Errorf("Get of an unfinished paste got error %v, want %v", err, ErrPasteNotFound)
+	}
+	if _, err := inner.Get(unfinished); err != ErrPasteNotFound {
+		t.Errorf("Unfinished paste was not deleted")
+	}
+	p, err := s.Get(kept)
+	if err != nil {
+		t.Fatalf("Get errored unexpectedly: %v", err)
+	}
+	p.Close()
+	if _, size := stats.Report(); size != p.Size() {
+		t.Errorf("Stats got %d bytes after recovering, want %d", size, p.Size())
+	}
+}
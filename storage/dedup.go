@@ -0,0 +1,306 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Digest of the blobs whose content is still being written
+const pendingDigest = "pending"
+
+// DedupStore wraps a store to keep a single copy of each unique content.
+// Content is kept in the wrapped store as blobs, identified by the SHA-256
+// hash of their content. Each paste is kept as a small record pointing at
+// its blob, holding its own metadata. Blobs are deleted along with the last
+// paste pointing at them. The wrapped store accounts for each blob and each
+// record, and the DedupStore for the bytes of each paste, as if its content
+// was not shared.
+type DedupStore struct {
+	wrapper
+	pastes  map[ID]*dedupCache
+	blobs   map[ID]*dedupBlob
+	digests map[string]ID
+}
+
+type dedupCache struct {
+	blob    ID
+	modTime time.Time
+	meta    Metadata
+	// unix time in nanoseconds of the last time it was read
+	lastRead atomic.Int64
+}
+
+type dedupBlob struct {
+	digest string
+	refs   int
+}
+
+type DedupPaste struct {
+	Paste
+	cache *dedupCache
+	// snapshot of the metadata when it was got
+	meta Metadata
+}
+
+func (p DedupPaste) ModTime() time.Time { return p.cache.modTime }
+
+func (p DedupPaste) Metadata() Metadata { return p.meta }
+
+// NewDedupStore returns a store keeping its content in inner, recovering
+// any pastes and blobs that it already holds. Blobs that no paste points
+// at are deleted. Pastes put in inner directly are kept as their own blob.
+func NewDedupStore(inner Lister, stats *Stats, expirer *Expirer) (*DedupStore, error) {
+	s := &DedupStore{
+		pastes:  make(map[ID]*dedupCache),
+		blobs:   make(map[ID]*dedupBlob),
+		digests: make(map[string]ID),
+	}
+	s.init(s, inner, stats, expirer)
+	s.content = s.blobOf
+	s.deleted = s.forget
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *DedupStore) recover() error {
+	ids, err := s.inner.List()
+	if err != nil {
+		return err
+	}
+	sizes := make(map[ID]int64)
+	for _, id := range ids {
+		p, err := s.inner.Get(id)
+		if err != nil {
+			return err
+		}
+		meta := p.Metadata()
+		modTime := p.ModTime()
+		sizes[id] = p.Size()
+		p.Close()
+		switch {
+		case meta.Blob != "":
+			blob, err := IDFromString(meta.Blob)
+			if err != nil {
+				return err
+			}
+			meta.Blob = ""
+			s.pastes[id] = &dedupCache{blob: blob, modTime: modTime, meta: meta}
+		case meta.Digest != "":
+			s.blobs[id] = &dedupBlob{digest: meta.Digest}
+		default:
+			s.blobs[id] = &dedupBlob{}
+			s.pastes[id] = &dedupCache{blob: id, modTime: modTime, meta: meta}
+		}
+	}
+	for id, cached := range s.pastes {
+		b, e := s.blobs[cached.blob]
+		if !e {
+			if err := s.inner.Delete(id); err != nil {
+				return err
+			}
+			delete(s.pastes, id)
+			continue
+		}
+		b.refs++
+	}
+	for id, b := range s.blobs {
+		if b.refs == 0 {
+			if err := s.inner.Delete(id); err != nil {
+				return err
+			}
+			delete(s.blobs, id)
+			continue
+		}
+		if b.digest != "" && b.digest != pendingDigest {
+			s.digests[b.digest] = id
+		}
+	}
+	for id, cached := range s.pastes {
+		if err := s.recovered(id, sizes[cached.blob], cached.meta.Expires); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DedupStore) Get(id ID) (Paste, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	cached, e := s.pastes[id]
+	if !e {
+		return nil, ErrPasteNotFound
+	}
+	p, err := s.inner.Get(cached.blob)
+	if err != nil {
+		return nil, err
+	}
+	cached.lastRead.Store(time.Now().UnixNano())
+	return DedupPaste{Paste: p, cache: cached, meta: cached.meta}, nil
+}
+
+func (s *DedupStore) Put(r io.Reader, meta Metadata) (ID, error) {
+	return s.put("", r, meta)
+}
+
+func (s *DedupStore) PutNamed(id ID, r io.Reader, meta Metadata) error {
+	if !id.Named() {
+		return errNotNamed
+	}
+	_, err := s.put(id, r, meta)
+	return err
+}
+
+// put puts a new paste in the wrapped store under id, or under a random ID
+// if it is empty. The content is put as a new blob first, which is dropped
+// if another one turns out to hold the same content.
+func (s *DedupStore) put(id ID, r io.Reader, meta Metadata) (ID, error) {
+	var blob ID
+	putInner := func(id ID, r io.Reader) (ID, error) {
+		hash := sha256.New()
+		newBlob, err := s.inner.Put(io.TeeReader(r, hash), Metadata{Digest: pendingDigest})
+		if err != nil {
+			return "", err
+		}
+		digest := hex.EncodeToString(hash.Sum(nil))
+		if blob, err = s.addRef(newBlob, digest); err != nil {
+			return "", err
+		}
+		if blob != newBlob {
+			// the same content was already kept
+			if err := s.inner.Delete(newBlob); err != nil {
+				s.dropRef(blob)
+				return "", err
+			}
+		}
+		recMeta := meta
+		recMeta.Blob = blob.String()
+		id, err = putIn(s.inner, id, strings.NewReader(recMeta.Blob), recMeta)
+		if err != nil {
+			s.dropRef(blob)
+			return "", err
+		}
+		return id, nil
+	}
+	return s.wrapper.put(id, r, meta, putInner, func(id ID) {
+		s.pastes[id] = &dedupCache{
+			blob:    blob,
+			modTime: time.Now(),
+			meta:    meta,
+		}
+	})
+}
+
+// addRef adds a reference to the blob holding the content with the given
+// digest, returning its ID. If there is none yet, newBlob becomes it.
+func (s *DedupStore) addRef(newBlob ID, digest string) (ID, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		s.inner.Delete(newBlob)
+		return "", ErrStoreClosed
+	}
+	if blob, e := s.digests[digest]; e {
+		s.blobs[blob].refs++
+		return blob, nil
+	}
+	err := s.inner.Update(newBlob, func(m *Metadata) { m.Digest = digest })
+	if err != nil {
+		s.inner.Delete(newBlob)
+		return "", err
+	}
+	s.blobs[newBlob] = &dedupBlob{digest: digest, refs: 1}
+	s.digests[digest] = newBlob
+	return newBlob, nil
+}
+
+// dropRef is like unref, for when the lock isn't held.
+func (s *DedupStore) dropRef(blob ID) {
+	s.Lock()
+	defer s.Unlock()
+	s.unref(blob)
+}
+
+// unref removes a reference to a blob, deleting it if it was the last one.
+// If that fails, the blob is kept without references until the store is
+// recovered.
+func (s *DedupStore) unref(blob ID) {
+	b := s.blobs[blob]
+	if b.refs--; b.refs > 0 {
+		return
+	}
+	if err := s.inner.Delete(blob); err != nil {
+		return
+	}
+	delete(s.blobs, blob)
+	if s.digests[b.digest] == blob {
+		delete(s.digests, b.digest)
+	}
+}
+
+func (s *DedupStore) Update(id ID, f func(*Metadata)) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	cached, e := s.pastes[id]
+	if !e {
+		return ErrPasteNotFound
+	}
+	meta := cached.meta
+	f(&meta)
+	err := s.inner.Update(id, func(m *Metadata) {
+		blob := m.Blob
+		*m = meta
+		m.Blob = blob
+	})
+	if err != nil {
+		return err
+	}
+	cached.meta = meta
+	return nil
+}
+
+// blobOf returns the blob of the paste known by id, and whether it is only
+// deleted along with it as the last paste that shares it.
+func (s *DedupStore) blobOf(id ID) (ID, bool) {
+	cached := s.pastes[id]
+	return cached.blob, s.blobs[cached.blob].refs == 1
+}
+
+// forget drops the paste known by id once its record has been deleted,
+// along with its blob if it was the last paste sharing it.
+func (s *DedupStore) forget(id ID) {
+	cached := s.pastes[id]
+	if cached.blob == id {
+		// kept as its own blob, from before it was wrapped
+		delete(s.blobs, id)
+	} else {
+		s.unref(cached.blob)
+	}
+	delete(s.pastes, id)
+}
+
+// Victim picks the paste to delete first among the ones in the store, as
+// the ones in the wrapped store are blobs and records.
+func (s *DedupStore) Victim(policy EvictPolicy) (ID, error) {
+	s.RLock()
+	defer s.RUnlock()
+	v := victim{policy: policy}
+	for id, cached := range s.pastes {
+		v.consider(id, cached.modTime, time.Unix(0, cached.lastRead.Load()))
+	}
+	return v.result()
+}
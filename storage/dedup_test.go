@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	physical := &Stats{}
+	inner, err := NewMemStore(physical, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logical := &Stats{}
+	s, err := NewDedupStore(inner, logical, NewExpirer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("same log\n", 100)
+	var ids []ID
+	for i := 0; i < 3; i++ {
+		id, err := s.Put(strings.NewReader(content), Metadata{})
+		if err != nil {
+			t.Fatalf("Put errored unexpectedly: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := s.Put(strings.NewReader("other"), Metadata{}); err != nil {
+		t.Fatalf("Put errored unexpectedly: %v", err)
+	}
+	if len(s.blobs) != 2 {
+		t.Errorf("Got %d blobs, want 2", len(s.blobs))
+	}
+	wantStats := func(stats *Stats, number int, size int64) {
+		t.Helper()
+		if n, stg := stats.Report(); n != number || stg != size {
+			t.Errorf("Stats got %d pastes using %d bytes, want %d using %d",
+				n, stg, number, size)
+		}
+	}
+	size := int64(len(content))
+	idLen := int64(DefaultIDFormat.Length)
+	wantStats(logical, 4, 3*size+5)
+	// one blob and one record per paste, holding the ID of the blob
+	wantStats(physical, 6, size+5+4*idLen)
+
+	for i, id := range ids {
+		if err := s.Delete(id); err != nil {
+			t.Fatalf("Delete(%s) errored unexpectedly: %v", id, err)
+		}
+		if gone := len(s.blobs) == 1; gone != (i == len(ids)-1) {
+			t.Errorf("Blob gone after deleting %d of %d pastes", i+1, len(ids))
+		}
+	}
+	wantStats(logical, 1, 5)
+	wantStats(physical, 2, 5+idLen)
+}
+
+func TestDedupRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastecat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	open := func() (*DedupStore, *Stats) {
+		inner, err := NewFileStore(&Stats{}, nil, time.Hour, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := &Stats{}
+		s, err := NewDedupStore(inner, stats, NewExpirer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, stats
+	}
+	s, _ := open()
+	first, err := s.Put(strings.NewReader("content"), Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(strings.NewReader("content"), Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	// a blob left behind by a crash while putting a paste
+	if _, err := s.inner.Put(strings.NewReader("partial"), Metadata{Digest: pendingDigest}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, stats := open()
+	if len(s.blobs) != 1 || len(s.digests) != 1 {
+		t.Errorf("Got %d blobs and %d digests after recovering, want 1 and 1",
+			len(s.blobs), len(s.digests))
+	}
+	if n, stg := stats.Report(); n != 2 || stg != 14 {
+		t.Errorf("Stats got %d pastes using %d bytes, want 2 using 14", n, stg)
+	}
+	if _, err := s.Put(strings.NewReader("content"), Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.blobs) != 1 {
+		t.Errorf("Recovered blob was not reused")
+	}
+	if err := s.Delete(first); err != nil {
+		t.Fatal(err)
+	}
+}
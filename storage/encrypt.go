@@ -0,0 +1,445 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Size of the chunks of content that are encrypted on their own, so
+	// that any of them can be read without decrypting the ones before
+	encryptChunkSize = 64 << 10
+	// Number of random bytes that the key of each paste is derived from
+	pasteSaltSize = 32
+	// Number of bytes that GCM adds to each chunk
+	encryptOverhead = 16
+)
+
+var errDecrypt = errors.New("paste content could not be decrypted")
+
+// A Keyring holds the keys to encrypt and decrypt pastes with, each known
+// by an ID. New pastes are encrypted with the key added last.
+type Keyring struct {
+	keys    map[string][]byte
+	current string
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string][]byte)}
+}
+
+// Add adds a key of 16, 24 or 32 bytes for AES-128, AES-192 or AES-256,
+// making it the one that new pastes are encrypted with.
+func (k *Keyring) Add(id string, key []byte) error {
+	if id == "" || strings.ContainsAny(id, " \t") {
+		return fmt.Errorf("invalid key id '%s'", id)
+	}
+	if _, e := k.keys[id]; e {
+		return fmt.Errorf("duplicate key id '%s'", id)
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("key %s: %v", id, err)
+	}
+	k.keys[id] = append([]byte(nil), key...)
+	k.current = id
+	return nil
+}
+
+// pasteAEAD returns the cipher of a paste, with its own key derived from
+// the key with the given ID and the salt kept in its metadata.
+func (k *Keyring) pasteAEAD(id string, salt []byte) (cipher.AEAD, error) {
+	key, e := k.keys[id]
+	if !e {
+		return nil, fmt.Errorf("unknown key %s", id)
+	}
+	if len(salt) != pasteSaltSize {
+		return nil, errors.New("invalid salt")
+	}
+	pasteKey, err := hkdf.Key(sha256.New, key, salt, "pastecat paste", len(key))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(pasteKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ReadKeyFile reads a keyring from the file at path. Each line holds the ID
+// of a key and the key in hexadecimal, separated by spaces. Lines starting
+// with '#' are ignored.
+func ReadKeyFile(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	k := NewKeyring()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key id and key", path, n)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: key is not hexadecimal", path, n)
+		}
+		if err := k.Add(fields[0], key); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if k.current == "" {
+		return nil, fmt.Errorf("%s: no keys found", path)
+	}
+	return k, nil
+}
+
+// EncryptStore wraps a store to keep the content of pastes encrypted with
+// AES-GCM. Each paste is encrypted with a key of its own, derived with HKDF
+// from a key in the keyring and a random salt. Each chunk of the content is
+// sealed on its own, so that any part of it can be read by decrypting a
+// single chunk. The ID of the key and the salt are kept in the metadata, so
+// that older keys can still decrypt the pastes encrypted with them. The rest
+// of the metadata is not encrypted. The wrapped store accounts for the
+// bytes once encrypted, tags included.
+type EncryptStore struct {
+	wrapper
+	keys *Keyring
+}
+
+type EncryptPaste struct {
+	sync.Mutex
+	raw  Paste
+	meta Metadata
+	size int64
+	aead cipher.AEAD
+	// offset to read from next
+	off int64
+
+	// last chunk decrypted, if any
+	chunk    []byte
+	chunkNum int64
+	sealed   []byte
+}
+
+func (p *EncryptPaste) Read(b []byte) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	n, err := p.readAt(b, p.off)
+	p.off += int64(n)
+	return n, err
+}
+
+func (p *EncryptPaste) ReadAt(b []byte, off int64) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	return p.readAt(b, off)
+}
+
+func (p *EncryptPaste) readAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(b) && off < p.size {
+		num := off / encryptChunkSize
+		chunk, err := p.readChunk(num)
+		if err != nil {
+			return n, err
+		}
+		c := copy(b[n:], chunk[off-num*encryptChunkSize:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readChunk returns the decrypted content of the chunk with the given
+// number.
+func (p *EncryptPaste) readChunk(num int64) ([]byte, error) {
+	if p.chunk != nil && p.chunkNum == num {
+		return p.chunk, nil
+	}
+	sealedSize := int64(encryptChunkSize + p.aead.Overhead())
+	start := num * sealedSize
+	end := start + sealedSize
+	last := end >= p.raw.Size()
+	if last {
+		end = p.raw.Size()
+	}
+	if cap(p.sealed) < int(sealedSize) {
+		p.sealed = make([]byte, sealedSize)
+	}
+	sealed := p.sealed[:end-start]
+	if _, err := p.raw.ReadAt(sealed, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	chunk, err := p.aead.Open(p.chunk[:0], chunkNonce(num), sealed, chunkData(last))
+	if err != nil {
+		p.chunk = nil
+		return nil, errDecrypt
+	}
+	p.chunk, p.chunkNum = chunk, num
+	return chunk, nil
+}
+
+func (p *EncryptPaste) Seek(offset int64, whence int) (int64, error) {
+	p.Lock()
+	defer p.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += p.off
+	case io.SeekEnd:
+		offset += p.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	p.off = offset
+	return offset, nil
+}
+
+func (p *EncryptPaste) Close() error { return p.raw.Close() }
+
+func (p *EncryptPaste) ModTime() time.Time { return p.raw.ModTime() }
+
+func (p *EncryptPaste) Size() int64 { return p.size }
+
+func (p *EncryptPaste) Metadata() Metadata { return p.meta }
+
+// chunkNonce returns the nonce of the chunk with the given number. Since
+// each paste has a key of its own, the number alone makes it unique.
+func chunkNonce(num int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(num))
+	return nonce
+}
+
+// chunkData returns the additional data that chunks are sealed with, which
+// tells the last one apart so that the content cannot be truncated.
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// decryptedSize returns the size of content that takes size bytes once
+// encrypted in chunks with the given overhead each.
+func decryptedSize(size int64, overhead int) int64 {
+	sealedSize := int64(encryptChunkSize + overhead)
+	full, rest := size/sealedSize, size%sealedSize
+	if rest > int64(overhead) {
+		rest -= int64(overhead)
+	} else {
+		rest = 0
+	}
+	return full*encryptChunkSize + rest
+}
+
+// decryptedMeta returns meta without the fields about how its content is
+// kept.
+func decryptedMeta(meta Metadata) Metadata {
+	meta.KeyID, meta.Nonce = "", ""
+	return meta
+}
+
+// NewEncryptStore returns a store keeping its content in inner encrypted
+// with the keys in keys, recovering any pastes that it already holds.
+// Pastes put in inner directly are kept unencrypted. Pastes encrypted with
+// keys that are not in keys make it fail.
+func NewEncryptStore(inner Lister, keys *Keyring, stats *Stats, expirer *Expirer) (*EncryptStore, error) {
+	s := &EncryptStore{keys: keys}
+	s.init(s, inner, stats, expirer)
+	ids, err := inner.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		p, err := inner.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		meta := p.Metadata()
+		size := p.Size()
+		p.Close()
+		if meta.KeyID != "" {
+			if _, e := keys.keys[meta.KeyID]; !e {
+				return nil, fmt.Errorf("paste %s is encrypted with unknown key %s", id, meta.KeyID)
+			}
+			size = decryptedSize(size, encryptOverhead)
+		}
+		if err := s.recovered(id, size, meta.Expires); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// encryptReader encrypts what it reads from r, one chunk at a time
+type encryptReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	chunk []byte
+	num   int64
+	// encrypted bytes not read yet
+	buf []byte
+	err error
+}
+
+func (er *encryptReader) Read(p []byte) (int, error) {
+	for len(er.buf) == 0 {
+		if er.err != nil {
+			return 0, er.err
+		}
+		er.fill()
+	}
+	n := copy(p, er.buf)
+	er.buf = er.buf[n:]
+	return n, nil
+}
+
+// fill encrypts the next chunk into buf.
+func (er *encryptReader) fill() {
+	n, err := io.ReadFull(er.r, er.chunk)
+	last := false
+	switch err {
+	case nil:
+		// a full chunk might still be the last one
+		if _, err := er.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			er.err = err
+			return
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	default:
+		er.err = err
+		return
+	}
+	er.buf = er.aead.Seal(er.buf[:0], chunkNonce(er.num), er.chunk[:n], chunkData(last))
+	er.num++
+	if last {
+		er.err = io.EOF
+	}
+}
+
+func (s *EncryptStore) Get(id ID) (Paste, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	size, e := s.sizes[id]
+	if !e {
+		return nil, ErrPasteNotFound
+	}
+	p, err := s.inner.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	meta := p.Metadata()
+	if meta.KeyID == "" {
+		return p, nil
+	}
+	salt, err := hex.DecodeString(meta.Nonce)
+	if err != nil {
+		p.Close()
+		return nil, fmt.Errorf("invalid salt of paste %s", id)
+	}
+	aead, err := s.keys.pasteAEAD(meta.KeyID, salt)
+	if err != nil {
+		p.Close()
+		return nil, fmt.Errorf("paste %s: %v", id, err)
+	}
+	return &EncryptPaste{
+		raw:  p,
+		meta: decryptedMeta(meta),
+		size: size,
+		aead: aead,
+	}, nil
+}
+
+func (s *EncryptStore) Put(r io.Reader, meta Metadata) (ID, error) {
+	return s.put("", r, meta)
+}
+
+func (s *EncryptStore) PutNamed(id ID, r io.Reader, meta Metadata) error {
+	if !id.Named() {
+		return errNotNamed
+	}
+	_, err := s.put(id, r, meta)
+	return err
+}
+
+// put puts a new paste in the wrapped store under id, or under a random ID
+// if it is empty.
+func (s *EncryptStore) put(id ID, r io.Reader, meta Metadata) (ID, error) {
+	salt := make([]byte, pasteSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	aead, err := s.keys.pasteAEAD(s.keys.current, salt)
+	if err != nil {
+		return "", err
+	}
+	kept := meta
+	kept.KeyID, kept.Nonce = s.keys.current, hex.EncodeToString(salt)
+	return s.wrapper.put(id, r, meta, func(id ID, r io.Reader) (ID, error) {
+		er := &encryptReader{
+			r:     bufio.NewReader(r),
+			aead:  aead,
+			chunk: make([]byte, encryptChunkSize),
+		}
+		return putIn(s.inner, id, er, kept)
+	}, nil)
+}
+
+func (s *EncryptStore) Update(id ID, f func(*Metadata)) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if _, e := s.sizes[id]; !e {
+		return ErrPasteNotFound
+	}
+	return s.inner.Update(id, func(m *Metadata) {
+		kept := *m
+		*m = decryptedMeta(kept)
+		f(m)
+		m.KeyID, m.Nonce = kept.KeyID, kept.Nonce
+	})
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T, ids ...string) *Keyring {
+	keys := NewKeyring()
+	for i, id := range ids {
+		if err := keys.Add(id, bytes.Repeat([]byte{byte(i)}, 32)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+func TestEncrypt(t *testing.T) {
+	inner, err := NewMemStore(&Stats{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewEncryptStore(inner, testKeyring(t, "old"), &Stats{}, NewExpirer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte(strings.Repeat("secret\n", encryptChunkSize/3))
+	oldID, err := s.Put(bytes.NewReader(content), Metadata{})
+	if err != nil {
+		t.Fatalf("Put errored unexpectedly: %v", err)
+	}
+	raw, err := inner.Get(oldID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(raw)
+	raw.Close()
+	if bytes.Contains(got, []byte("secret")) {
+		t.Errorf("Content was kept unencrypted")
+	}
+
+	// rotating the keys keeps the old pastes readable
+	if _, err := NewEncryptStore(inner, testKeyring(t, "new"), &Stats{}, nil); err == nil {
+		t.Errorf("NewEncryptStore without the key of a paste did not error")
+	}
+	stats := &Stats{}
+	if s, err = NewEncryptStore(inner, testKeyring(t, "old", "new"), stats, nil); err != nil {
+		t.Fatalf("NewEncryptStore errored unexpectedly: %v", err)
+	}
+	if _, size := stats.Report(); size != int64(len(content)) {
+		t.Errorf("Stats got %d bytes after recovering, want %d", size, len(content))
+	}
+	newID, err := s.Put(bytes.NewReader(content), Metadata{})
+	if err != nil {
+		t.Fatalf("Put errored unexpectedly: %v", err)
+	}
+	for id, keyID := range map[ID]string{oldID: "old", newID: "new"} {
+		raw, err := inner.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw.Close()
+		if got := raw.Metadata().KeyID; got != keyID {
+			t.Errorf("Paste %s was encrypted with key %s, want %s", id, got, keyID)
+		}
+		p, err := s.Get(id)
+		if err != nil {
+			t.Fatalf("Get errored unexpectedly: %v", err)
+		}
+		// across the end of the first chunk
+		off := int64(encryptChunkSize - 10)
+		buf := make([]byte, 20)
+		if n, err := p.ReadAt(buf, off); err != nil || !bytes.Equal(buf[:n], content[off:off+20]) {
+			t.Errorf("ReadAt(%d) got %q and error %v", off, buf[:n], err)
+		}
+		if got, err := ioutil.ReadAll(p); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("Reading %s got %d bytes and error %v", id, len(got), err)
+		}
+		p.Close()
+	}
+}
+
+func TestEncryptSalts(t *testing.T) {
+	inner, err := NewMemStore(&Stats{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeyring(t, "key")
+	content := strings.Repeat("secret\n", encryptChunkSize/3)
+	badID, err := inner.Put(strings.NewReader("foo"), Metadata{KeyID: "key", Nonce: "abcd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewEncryptStore(inner, keys, &Stats{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []ID
+	var sealed [][]byte
+	for i := 0; i < 2; i++ {
+		id, err := s.Put(strings.NewReader(content), Metadata{})
+		if err != nil {
+			t.Fatalf("Put errored unexpectedly: %v", err)
+		}
+		raw, err := inner.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(raw)
+		raw.Close()
+		if salt, err := hex.DecodeString(raw.Metadata().Nonce); err != nil || len(salt) != pasteSaltSize {
+			t.Errorf("Paste %s got salt %q, want %d random bytes", id, raw.Metadata().Nonce, pasteSaltSize)
+		}
+		ids = append(ids, id)
+		sealed = append(sealed, got)
+	}
+	if bytes.Equal(sealed[0][:encryptChunkSize], sealed[1][:encryptChunkSize]) {
+		t.Errorf("Two pastes with the same content were encrypted alike")
+	}
+	for _, id := range ids {
+		p, err := s.Get(id)
+		if err != nil {
+			t.Fatalf("Get errored unexpectedly: %v", err)
+		}
+		if got, err := ioutil.ReadAll(p); err != nil || string(got) != content {
+			t.Errorf("Reading %s got %d bytes and error %v", id, len(got), err)
+		}
+		p.Close()
+	}
+	if _, err := s.Get(badID); err == nil {
+		t.Errorf("Get of a paste with an invalid salt did not error")
+	}
+}
+
+func TestEncryptTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastecat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys := testKeyring(t, "key")
+	inner, err := NewFileStore(&Stats{}, nil, 0, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewEncryptStore(inner, keys, &Stats{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("x", 2*encryptChunkSize)
+	id, err := s.Put(strings.NewReader(content), Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	// drop the last chunk, as if it had never been there
+	path := filepath.Join(dir, pathFromID(id))
+	if err := os.Truncate(path, encryptChunkSize+16); err != nil {
+		t.Fatal(err)
+	}
+	if inner, err = NewFileStore(&Stats{}, nil, 0, dir); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = NewEncryptStore(inner, keys, &Stats{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, err := io.Copy(ioutil.Discard, p); err != errDecrypt {
+		t.Errorf("Reading a truncated paste got error %v, want %v", err, errDecrypt)
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastecat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := strings.Repeat("ab", 32)
+	for _, c := range []struct {
+		in          string
+		wantCurrent string
+		wantErr     bool
+	}{
+		{"", "", true},
+		{"# only a comment\n", "", true},
+		{"a " + key + "\n", "a", false},
+		{"a " + key + "\n\n# rotated\nb " + key + "\n", "b", false},
+		{"a " + key + "\na " + key + "\n", "", true},
+		{"a " + key[:10] + "\n", "", true},
+		{"a nothex\n", "", true},
+		{"a\n", "", true},
+	} {
+		path := filepath.Join(dir, "keys")
+		if err := ioutil.WriteFile(path, []byte(c.in), 0600); err != nil {
+			t.Fatal(err)
+		}
+		k, err := ReadKeyFile(path)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("ReadKeyFile of %q did not error as expected", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReadKeyFile of %q errored unexpectedly: %v", c.in, err)
+		} else if k.current != c.wantCurrent {
+			t.Errorf("ReadKeyFile of %q got current key %s, want %s", c.in, k.current, c.wantCurrent)
+		}
+	}
+}
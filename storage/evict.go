@@ -0,0 +1,92 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// EvictPolicy decides which pastes are deleted first to make room for new
+// ones once the storage limits are reached
+type EvictPolicy int
+
+const (
+	// EvictNone never deletes pastes to make room for new ones
+	EvictNone EvictPolicy = iota
+	// EvictOldest deletes the pastes that were created first
+	EvictOldest
+	// EvictLeastRead deletes the pastes that were read least recently
+	EvictLeastRead
+)
+
+var evictPolicyNames = [...]string{
+	EvictNone:      "none",
+	EvictOldest:    "oldest",
+	EvictLeastRead: "least-read",
+}
+
+func (p EvictPolicy) String() string {
+	return evictPolicyNames[p]
+}
+
+func (p *EvictPolicy) Set(value string) error {
+	for i, name := range evictPolicyNames {
+		if name == value {
+			*p = EvictPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown eviction policy '%s'", value)
+}
+
+// An Evictable store can pick which of its pastes should be deleted first
+// to make room for new ones
+type Evictable interface {
+	Store
+
+	// Victim returns the ID of the paste that should be deleted first
+	// under the given policy, or ErrPasteNotFound if there are none.
+	Victim(policy EvictPolicy) (ID, error)
+}
+
+// EvictFunc returns a function that deletes one paste from s under the
+// given policy, to be used as a Stats' Evict.
+func EvictFunc(s Evictable, policy EvictPolicy) func() error {
+	if policy == EvictNone {
+		return nil
+	}
+	return func() error {
+		id, err := s.Victim(policy)
+		if err != nil {
+			return err
+		}
+		return s.Delete(id)
+	}
+}
+
+// victim keeps track of the best paste to evict seen so far
+type victim struct {
+	policy EvictPolicy
+	id     ID
+	time   time.Time
+	found  bool
+}
+
+func (v *victim) consider(id ID, modTime, lastRead time.Time) {
+	t := modTime
+	if v.policy == EvictLeastRead && lastRead.After(modTime) {
+		t = lastRead
+	}
+	if !v.found || t.Before(v.time) {
+		v.id, v.time, v.found = id, t, true
+	}
+}
+
+func (v *victim) result() (ID, error) {
+	if !v.found {
+		return v.id, ErrPasteNotFound
+	}
+	return v.id, nil
+}
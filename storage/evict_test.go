@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvictPolicySet(t *testing.T) {
+	for _, c := range []struct {
+		in      string
+		want    EvictPolicy
+		wantErr bool
+	}{
+		{"", EvictNone, true},
+		{"foo", EvictNone, true},
+		{"none", EvictNone, false},
+		{"oldest", EvictOldest, false},
+		{"least-read", EvictLeastRead, false},
+	} {
+		var got EvictPolicy
+		err := got.Set(c.in)
+		if c.wantErr && err == nil {
+			t.Errorf(`Set("%s") did not error as expected`, c.in)
+		}
+		if got != c.want {
+			t.Errorf(`Set("%s") got %s, want %s`, c.in, got, c.want)
+		}
+	}
+}
+
+func TestEvict(t *testing.T) {
+	for _, c := range []struct {
+		policy  EvictPolicy
+		wantErr bool
+		// index of the paste that should have been evicted
+		wantGone int
+	}{
+		{EvictNone, true, -1},
+		{EvictOldest, false, 0},
+		{EvictLeastRead, false, 1},
+	} {
+		stats := &Stats{MaxNumber: 2}
+		s, _ := NewMemStore(stats, newTestExpirer())
+		stats.Evict = EvictFunc(s, c.policy)
+		var ids [2]ID
+		for i := range ids {
+			id, err := s.Put(strings.NewReader("content"), Metadata{})
+			if err != nil {
+				t.Fatalf("Put errored unexpectedly: %v", err)
+			}
+			// make the first paste the oldest one
+			s.cache[id].modTime = s.cache[id].modTime.Add(time.Duration(i))
+			ids[i] = id
+		}
+		p, _ := s.Get(ids[0])
+		p.Close()
+		_, err := s.Put(strings.NewReader("content"), Metadata{})
+		if c.wantErr {
+			if err != ErrReachedMaxNumber {
+				t.Errorf("%s got error %v, want %v", c.policy, err, ErrReachedMaxNumber)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s errored unexpectedly: %v", c.policy, err)
+		}
+		if _, err := s.Get(ids[c.wantGone]); err != ErrPasteNotFound {
+			t.Errorf("%s did not evict the expected paste", c.policy)
+		}
+		if num, _ := stats.Report(); num != 2 {
+			t.Errorf("%s left %d pastes, want 2", c.policy, num)
+		}
+	}
+}
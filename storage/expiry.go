@@ -0,0 +1,298 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"container/heap"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of times to retry deleting a paste
+	deleteRetries = 5
+	// How long to wait before retrying to delete a paste
+	deleteRetryTimeout = 1 * time.Minute
+	// How long to wait before trying again to delete a paste that was
+	// being read
+	busyRetryTimeout = 10 * time.Second
+	// Number of times to wait for the readers of a paste before deleting
+	// it once they are done, blocking its store meanwhile
+	busyRetries = 30
+	// Number of failures to keep track of for inspection
+	maxFailures = 100
+)
+
+// An Expirer deletes pastes from their stores once they expire. It keeps a
+// single index of pending deletions sorted by time, swept by one worker, so
+// that it can be shared by any number of stores. A nil Expirer never
+// deletes anything, for stores whose pastes are deleted by a wrapper.
+//
+// The index is kept in memory, and persistent stores add their pastes to it
+// again when they are opened. The file stores keep the expiry times on disk
+// for that, so that they need not read the metadata of every paste.
+type Expirer struct {
+	sync.Mutex
+	queue   expiryQueue
+	entries map[expiryKey]*expiryEntry
+	// signals the worker that the earliest deletion changed
+	wake chan struct{}
+
+	deleted, retried, gaveUp int64
+	failures                 []ExpiryFailure
+}
+
+// ExpiryReport holds the counters of an Expirer
+type ExpiryReport struct {
+	// Number of deletions waiting to happen
+	Pending int
+	// Number of pastes deleted once expired
+	Deleted int64
+	// Number of deletions that failed and were retried
+	Retried int64
+	// Number of deletions that were given up on
+	GaveUp int64
+}
+
+// ExpiryFailure records a deletion that failed
+type ExpiryFailure struct {
+	ID       ID
+	Time     time.Time
+	Attempts int
+	Err      error
+	// Whether the deletion was given up on instead of being retried
+	GaveUp bool
+}
+
+type expiryKey struct {
+	store Store
+	id    ID
+}
+
+type expiryEntry struct {
+	expiryKey
+	at       time.Time
+	attempts int
+	// number of times the paste was being read when it was due
+	busy int
+	// position in the queue, kept up to date by the heap
+	index int
+}
+
+// expiryQueue is a min-heap of entries sorted by time
+type expiryQueue []*expiryEntry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	e := x.(*expiryEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return e
+}
+
+// NewExpirer returns a new Expirer with its worker already running.
+func NewExpirer() *Expirer {
+	e := &Expirer{
+		entries: make(map[expiryKey]*expiryEntry),
+		wake:    make(chan struct{}, 1),
+	}
+	go e.run()
+	return e
+}
+
+// Add schedules the paste known by id to be deleted from s at the given
+// time, replacing any previous deletion scheduled for it. A zero time means
+// that the paste never expires.
+func (e *Expirer) Add(s Store, id ID, at time.Time) {
+	if e == nil || at.IsZero() {
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.schedule(&expiryEntry{expiryKey: expiryKey{s, id}, at: at})
+}
+
+func (e *Expirer) schedule(entry *expiryEntry) {
+	if old, ok := e.entries[entry.expiryKey]; ok {
+		heap.Remove(&e.queue, old.index)
+	}
+	e.entries[entry.expiryKey] = entry
+	heap.Push(&e.queue, entry)
+	if entry.index == 0 {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Remove cancels the deletion scheduled for the paste known by id in s, if
+// any. Stores call it when a paste is deleted before it expires.
+func (e *Expirer) Remove(s Store, id ID) {
+	if e == nil {
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	key := expiryKey{s, id}
+	if entry, ok := e.entries[key]; ok {
+		heap.Remove(&e.queue, entry.index)
+		delete(e.entries, key)
+	}
+}
+
+// Report returns the current counters of the Expirer.
+func (e *Expirer) Report() ExpiryReport {
+	e.Lock()
+	defer e.Unlock()
+	return ExpiryReport{
+		Pending: len(e.queue),
+		Deleted: e.deleted,
+		Retried: e.retried,
+		GaveUp:  e.gaveUp,
+	}
+}
+
+// Failures returns the most recent deletions that failed, oldest first.
+func (e *Expirer) Failures() []ExpiryFailure {
+	e.Lock()
+	defer e.Unlock()
+	return append([]ExpiryFailure(nil), e.failures...)
+}
+
+func (e *Expirer) run() {
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+			e.sweep(time.Now())
+		case <-e.wake:
+		}
+		timer.Reset(e.next(time.Now()))
+	}
+}
+
+// next returns how long to wait until the earliest deletion is due.
+func (e *Expirer) next(now time.Time) time.Duration {
+	e.Lock()
+	defer e.Unlock()
+	if len(e.queue) == 0 {
+		return time.Hour
+	}
+	return e.queue[0].at.Sub(now)
+}
+
+// sweep deletes all the pastes that are due at the given time.
+func (e *Expirer) sweep(now time.Time) {
+	for {
+		e.Lock()
+		if len(e.queue) == 0 || e.queue[0].at.After(now) {
+			e.Unlock()
+			return
+		}
+		entry := heap.Pop(&e.queue).(*expiryEntry)
+		delete(e.entries, entry.expiryKey)
+		e.Unlock()
+
+		var err error
+		if entry.busy < busyRetries {
+			err = deleteUnlessBusy(entry.store, entry.id)
+		} else {
+			err = entry.store.Delete(entry.id)
+		}
+		if err == ErrPasteNotFound || err == ErrStoreClosed {
+			continue
+		}
+		e.Lock()
+		if err == errPasteBusy {
+			entry.busy++
+			e.retry(entry, now.Add(busyRetryTimeout))
+		} else {
+			e.done(entry, now, err)
+		}
+		e.Unlock()
+	}
+}
+
+// done records the outcome of an attempt to delete an expired paste,
+// scheduling a retry if it failed.
+func (e *Expirer) done(entry *expiryEntry, now time.Time, err error) {
+	if err == nil {
+		e.deleted++
+		return
+	}
+	entry.attempts++
+	failure := ExpiryFailure{
+		ID:       entry.id,
+		Time:     now,
+		Attempts: entry.attempts,
+		Err:      err,
+		GaveUp:   entry.attempts > deleteRetries,
+	}
+	if len(e.failures) == maxFailures {
+		e.failures = e.failures[1:]
+	}
+	e.failures = append(e.failures, failure)
+	if failure.GaveUp {
+		e.gaveUp++
+		log.Printf("Giving up on deleting %s after %d attempts: %v", entry.id, entry.attempts, err)
+		return
+	}
+	e.retried++
+	log.Printf("Could not delete %s, trying again in %s: %v", entry.id, deleteRetryTimeout, err)
+	e.retry(entry, now.Add(deleteRetryTimeout))
+}
+
+// retry schedules the deletion of entry again at the given time, unless
+// another one was scheduled for its paste in the meantime.
+func (e *Expirer) retry(entry *expiryEntry, at time.Time) {
+	if _, ok := e.entries[entry.expiryKey]; !ok {
+		entry.at = at
+		e.schedule(entry)
+	}
+}
+
+var errPasteBusy = errors.New("paste is being read")
+
+// A busyStore can tell whether its pastes are being read, so that they can
+// be deleted without waiting for their readers.
+type busyStore interface {
+	// busy reports whether the paste known by id is being read.
+	busy(id ID) bool
+	// deleteUnlessBusy is like Delete, but it fails with errPasteBusy
+	// instead of waiting for the readers of the paste.
+	deleteUnlessBusy(id ID) error
+}
+
+// busyIn reports whether the paste known by id in s is being read.
+func busyIn(s Store, id ID) bool {
+	b, ok := s.(busyStore)
+	return ok && b.busy(id)
+}
+
+// deleteUnlessBusy deletes the paste known by id from s, failing with
+// errPasteBusy if s would have to wait for its readers.
+func deleteUnlessBusy(s Store, id ID) error {
+	if b, ok := s.(busyStore); ok {
+		return b.deleteUnlessBusy(id)
+	}
+	return s.Delete(id)
+}
@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failStore is a Store whose deletions fail a number of times before
+// succeeding
+type failStore struct {
+	fails   int
+	deletes int
+}
+
+func (s *failStore) Get(id ID) (Paste, error)                   { return nil, ErrPasteNotFound }
+func (s *failStore) Put(r io.Reader, meta Metadata) (ID, error) { return "", nil }
+func (s *failStore) Update(id ID, f func(*Metadata)) error      { return ErrPasteNotFound }
+func (s *failStore) Close() error                               { return nil }
+
+func (s *failStore) Delete(id ID) error {
+	s.deletes++
+	if s.deletes <= s.fails {
+		return errors.New("cannot delete")
+	}
+	return nil
+}
+
+// busyFailStore is a failStore whose pastes are being read a number of
+// times it is asked to delete them
+type busyFailStore struct {
+	failStore
+	busyTimes int
+}
+
+func (s *busyFailStore) busy(id ID) bool { return s.busyTimes > 0 }
+
+func (s *busyFailStore) deleteUnlessBusy(id ID) error {
+	if s.busyTimes > 0 {
+		s.busyTimes--
+		return errPasteBusy
+	}
+	return s.Delete(id)
+}
+
+func newTestExpirer() *Expirer {
+	return &Expirer{
+		entries: make(map[expiryKey]*expiryEntry),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func TestExpirerSweep(t *testing.T) {
+	e := newTestExpirer()
+	s := &failStore{}
+	now := time.Now()
+	e.Add(s, ID("01"), now.Add(2*time.Minute))
+	e.Add(s, ID("02"), now.Add(time.Minute))
+	e.Add(s, ID("03"), time.Time{})
+	e.Add(s, ID("04"), now.Add(time.Hour))
+	e.Remove(s, ID("04"))
+	if got := e.Report().Pending; got != 2 {
+		t.Fatalf("Pending got %d, want 2", got)
+	}
+	if got := e.next(now); got != time.Minute {
+		t.Errorf("next() got %s, want %s", got, time.Minute)
+	}
+	e.sweep(now.Add(time.Minute))
+	if got := e.Report(); got.Pending != 1 || got.Deleted != 1 {
+		t.Errorf("Report() after first sweep got %+v", got)
+	}
+	e.sweep(now.Add(time.Hour))
+	if got := e.Report(); got.Pending != 0 || got.Deleted != 2 {
+		t.Errorf("Report() after second sweep got %+v", got)
+	}
+}
+
+func TestExpirerRetries(t *testing.T) {
+	for _, c := range []struct {
+		fails      int
+		wantGaveUp bool
+	}{
+		{0, false},
+		{1, false},
+		{deleteRetries, false},
+		{deleteRetries + 1, true},
+	} {
+		e := newTestExpirer()
+		s := &failStore{fails: c.fails}
+		now := time.Now()
+		e.Add(s, ID("01"), now)
+		for i := 0; i <= deleteRetries; i++ {
+			e.sweep(now)
+			now = now.Add(deleteRetryTimeout)
+		}
+		got := e.Report()
+		if got.Pending != 0 {
+			t.Errorf("%d failures left %d pending", c.fails, got.Pending)
+		}
+		if (got.GaveUp == 1) != c.wantGaveUp {
+			t.Errorf("%d failures got %d given up, want %t", c.fails, got.GaveUp, c.wantGaveUp)
+		}
+		if !c.wantGaveUp && (got.Deleted != 1 || got.Retried != int64(c.fails)) {
+			t.Errorf("%d failures got %+v", c.fails, got)
+		}
+		failures := e.Failures()
+		if len(failures) != c.fails {
+			t.Errorf("%d failures got %d recorded", c.fails, len(failures))
+			continue
+		}
+		for i, f := range failures {
+			if f.ID != ID("01") || f.Attempts != i+1 || f.Err == nil {
+				t.Errorf("%d failures got failure %d %+v", c.fails, i, f)
+			}
+			if last := i == len(failures)-1; f.GaveUp != (last && c.wantGaveUp) {
+				t.Errorf("%d failures got failure %d given up: %t", c.fails, i, f.GaveUp)
+			}
+		}
+	}
+}
+
+func TestExpirerBusy(t *testing.T) {
+	e := newTestExpirer()
+	s := &busyFailStore{busyTimes: 2}
+	now := time.Now()
+	e.Add(s, ID("01"), now)
+	for i := 0; i < 2; i++ {
+		e.sweep(now)
+		if got := e.Report(); got.Pending != 1 || got.Deleted != 0 || got.Retried != 0 {
+			t.Fatalf("Report() while busy got %+v", got)
+		}
+		if got := e.next(now); got != busyRetryTimeout {
+			t.Fatalf("next() while busy got %s, want %s", got, busyRetryTimeout)
+		}
+		now = now.Add(busyRetryTimeout)
+	}
+	e.sweep(now)
+	if got := e.Report(); got.Pending != 0 || got.Deleted != 1 {
+		t.Errorf("Report() once not busy got %+v", got)
+	}
+}
+
+func TestExpirerBusyForever(t *testing.T) {
+	e := newTestExpirer()
+	s := &busyFailStore{busyTimes: 2 * busyRetries}
+	now := time.Now()
+	e.Add(s, ID("01"), now)
+	for i := 0; i < busyRetries; i++ {
+		e.sweep(now)
+		now = now.Add(busyRetryTimeout)
+	}
+	if got := e.Report(); got.Pending != 1 || s.deletes != 0 {
+		t.Fatalf("Report() while busy got %+v with %d deletes", got, s.deletes)
+	}
+	// waits for the readers from then on
+	e.sweep(now)
+	if got := e.Report(); got.Pending != 0 || got.Deleted != 1 || s.deletes != 1 {
+		t.Errorf("Report() after waiting too long got %+v with %d deletes", got, s.deletes)
+	}
+}
+
+func TestDeleteUnlessBusy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastecat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFileStore(&Stats{}, nil, 0, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewCompressStore(fs, &Stats{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	id, err := s.Put(strings.NewReader("foo"), Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteUnlessBusy(s, id); err != errPasteBusy {
+		t.Fatalf("deleteUnlessBusy while reading got error %v, want %v", err, errPasteBusy)
+	}
+	p.Close()
+	if err := deleteUnlessBusy(s, id); err != nil {
+		t.Fatalf("deleteUnlessBusy once read errored unexpectedly: %v", err)
+	}
+	if _, err := s.Get(id); err != ErrPasteNotFound {
+		t.Fatalf("Get after deleting got error %v, want %v", err, ErrPasteNotFound)
+	}
+}
+
+func TestDedupDeleteUnlessBusy(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStore(&Stats{}, nil, 0, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewDedupStore(fs, &Stats{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var ids []ID
+	for i := 0; i < 2; i++ {
+		id, err := s.Put(strings.NewReader("foo"), Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	p, err := s.Get(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// the blob being read is kept for the other paste
+	if err := deleteUnlessBusy(s, ids[1]); err != nil {
+		t.Fatalf("deleteUnlessBusy of a paste sharing its blob errored unexpectedly: %v", err)
+	}
+	if err := deleteUnlessBusy(s, ids[0]); err != errPasteBusy {
+		t.Fatalf("deleteUnlessBusy of the last paste while reading got error %v, want %v", err, errPasteBusy)
+	}
+}
+
+func TestExpiryIndex(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore(&Stats{}, nil, 0, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	soon, err := s.Put(strings.NewReader("soon"), Metadata{Expires: expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	never, err := s.Put(strings.NewReader("never"), Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, err := s.Put(strings.NewReader("gone"), Metadata{Expires: time.Now().Add(time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	time.Sleep(time.Millisecond)
+
+	// the times come from the index, and not from the metadata
+	if err := os.Remove(filepath.Join(dir, pathFromID(soon)+metaSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	// a crash while adding a paste leaves a line cut short
+	f, err := os.OpenFile(filepath.Join(dir, expiryIndexName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("12"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	e := newTestExpirer()
+	s, err = NewFileStore(&Stats{}, e, 0, dir)
+	if err != nil {
+		t.Fatalf("Could not reopen the store: %v", err)
+	}
+	defer s.Close()
+	if got := e.Report().Pending; got != 1 {
+		t.Errorf("Pending after reopening got %d, want 1", got)
+	}
+	p, err := s.Get(soon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Metadata().Expires; !got.Equal(expires) {
+		t.Errorf("Expires after reopening got %v, want %v", got, expires)
+	}
+	p.Close()
+	if p, err := s.Get(never); err != nil {
+		t.Errorf("Get of a paste that never expires errored unexpectedly: %v", err)
+	} else {
+		p.Close()
+	}
+	if _, err := s.Get(gone); err != ErrPasteNotFound {
+		t.Errorf("Get of an expired paste got error %v, want %v", err, ErrPasteNotFound)
+	}
+}
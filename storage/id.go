@@ -0,0 +1,301 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// Minimum and maximum length of the IDs of pastes
+	minIDLen = 4
+	maxIDLen = 64
+	// Prefix of the IDs of pastes with a name chosen by the uploader,
+	// which keeps them apart from random IDs
+	namePrefix = "~"
+	// Minimum and maximum length of the names chosen by uploaders
+	minNameLen = 3
+	maxNameLen = 64
+	// Number of times to try getting an unused random paste id
+	randTries = 10
+)
+
+// ID is the identifier of a paste, in its canonical textual form. Random
+// IDs are made of ASCII letters and digits, along with hyphens between
+// words. IDs starting with a tilde hold a name chosen by the uploader
+// instead, as given by NamedID.
+type ID string
+
+// IDFromString parses a string into an ID. IDs in any format are accepted,
+// so that pastes keep working after changing the format of new IDs. Returns
+// the ID and an error, if any.
+func IDFromString(s string) (ID, error) {
+	if strings.HasPrefix(s, namePrefix) {
+		return NamedID(s[len(namePrefix):])
+	}
+	if len(s) < minIDLen || len(s) > maxIDLen {
+		return "", fmt.Errorf("invalid id at %s", s)
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c == '-' && i > 0 && i < len(s)-1 && s[i-1] != '-':
+		default:
+			return "", fmt.Errorf("invalid id at %s", s)
+		}
+	}
+	return ID(s), nil
+}
+
+// NamedID returns the ID of the paste with the given name, which must be
+// made of ASCII letters, digits, dots, hyphens and underscores, not
+// starting with a dot. Names are case sensitive.
+func NamedID(name string) (ID, error) {
+	if len(name) < minNameLen || len(name) > maxNameLen || name[0] == '.' {
+		return "", fmt.Errorf("invalid name %s", name)
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c == '.', c == '-', c == '_':
+		default:
+			return "", fmt.Errorf("invalid name %s", name)
+		}
+	}
+	return ID(namePrefix + name), nil
+}
+
+// Named reports whether id holds a name chosen by the uploader.
+func (id ID) Named() bool {
+	return strings.HasPrefix(string(id), namePrefix)
+}
+
+func (id ID) String() string {
+	return string(id)
+}
+
+// CaseInsensitive reports whether IDs in format f are the same regardless
+// of the case of their letters, which is all but IDBase62.
+func (f IDFormat) CaseInsensitive() bool {
+	return f.Encoding != IDBase62
+}
+
+// IDEncoding is the set of characters or words that random IDs are made of
+type IDEncoding int
+
+const (
+	// IDHex uses hexadecimal digits in lower case
+	IDHex IDEncoding = iota
+	// IDBase62 uses ASCII digits and letters in both cases
+	IDBase62
+	// IDBase32 uses Crockford's base32 alphabet in lower case, which
+	// leaves out letters that are easily mistaken for others
+	IDBase32
+	// IDWords uses common English words, joined by hyphens
+	IDWords
+)
+
+var idEncodingNames = [...]string{
+	IDHex:    "hex",
+	IDBase62: "base62",
+	IDBase32: "base32",
+	IDWords:  "words",
+}
+
+// Characters that random IDs are made of in each encoding, other than
+// IDWords
+var idAlphabets = [...]string{
+	IDHex:    "0123456789abcdef",
+	IDBase62: "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+	IDBase32: "0123456789abcdefghjkmnpqrstvwxyz",
+}
+
+// Length of the random IDs in each encoding when not given, in characters
+// or in words
+var idDefaultLengths = [...]int{
+	IDHex:    8,
+	IDBase62: 8,
+	IDBase32: 10,
+	IDWords:  4,
+}
+
+// IDFormat is the format of the random IDs given to new pastes, written as
+// the name of its encoding followed by its length, such as "base62:10".
+// The length may be left out to use the default of the encoding.
+type IDFormat struct {
+	Encoding IDEncoding
+	// Number of characters, or of words with IDWords
+	Length int
+}
+
+// DefaultIDFormat is the format of new IDs unless set otherwise, which
+// gives 2^32 different IDs
+var DefaultIDFormat = IDFormat{Encoding: IDHex, Length: 8}
+
+func (f IDFormat) String() string {
+	return fmt.Sprintf("%s:%d", idEncodingNames[f.Encoding], f.Length)
+}
+
+func (f *IDFormat) Set(value string) error {
+	name, length, hasLength := strings.Cut(value, ":")
+	enc := -1
+	for i, n := range idEncodingNames {
+		if n == name {
+			enc = i
+		}
+	}
+	if enc < 0 {
+		return fmt.Errorf("unknown id encoding '%s'", name)
+	}
+	nf := IDFormat{Encoding: IDEncoding(enc), Length: idDefaultLengths[enc]}
+	if hasLength {
+		n, err := strconv.Atoi(length)
+		if err != nil {
+			return fmt.Errorf("invalid id length '%s'", length)
+		}
+		nf.Length = n
+	}
+	if min, max := nf.lenRange(); min < minIDLen || max > maxIDLen {
+		return fmt.Errorf("id length %d out of range for %s", nf.Length, name)
+	}
+	*f = nf
+	return nil
+}
+
+// lenRange returns the minimum and maximum length of the IDs given in f.
+func (f IDFormat) lenRange() (int, int) {
+	if f.Encoding != IDWords {
+		return f.Length, f.Length
+	}
+	min, max := len(idWords[0]), len(idWords[0])
+	for _, w := range idWords {
+		if len(w) < min {
+			min = len(w)
+		}
+		if len(w) > max {
+			max = len(w)
+		}
+	}
+	seps := f.Length - 1
+	return f.Length*min + seps, f.Length*max + seps
+}
+
+// random returns a new random ID in format f.
+func (f IDFormat) random() (ID, error) {
+	b := make([]byte, f.Length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	if f.Encoding == IDWords {
+		words := make([]string, len(b))
+		for i, c := range b {
+			words[i] = idWords[c]
+		}
+		return ID(strings.Join(words, "-")), nil
+	}
+	alphabet := idAlphabets[f.Encoding]
+	// reject the values past the last multiple of the alphabet size,
+	// which would make the first characters more likely
+	limit := 256 - 256%len(alphabet)
+	for i := 0; i < len(b); i++ {
+		for int(b[i]) >= limit {
+			var c [1]byte
+			if _, err := rand.Read(c[:]); err != nil {
+				return "", err
+			}
+			b[i] = c[0]
+		}
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return ID(b), nil
+}
+
+// Format of the IDs given to new pastes by all stores
+var idFormat atomic.Pointer[IDFormat]
+
+// SetIDFormat sets the format of the IDs given to new pastes from then on.
+// The IDs of existing pastes are kept as they are.
+func SetIDFormat(f IDFormat) {
+	idFormat.Store(&f)
+}
+
+// CurrentIDFormat returns the format of the IDs given to new pastes.
+func CurrentIDFormat() IDFormat {
+	if f := idFormat.Load(); f != nil {
+		return *f
+	}
+	return DefaultIDFormat
+}
+
+// pickID returns id if it is available, or an available random ID if it is
+// empty.
+func pickID(id ID, available func(ID) bool) (ID, error) {
+	if id == "" {
+		return randomID(available)
+	}
+	if !available(id) {
+		return "", ErrNameTaken
+	}
+	return id, nil
+}
+
+func randomID(available func(ID) bool) (ID, error) {
+	f := CurrentIDFormat()
+	for try := 0; try < randTries; try++ {
+		id, err := f.random()
+		if err != nil {
+			continue
+		}
+		if available(id) {
+			return id, nil
+		}
+	}
+	return "", ErrNoUnusedIDFound
+}
+
+// Words that IDWords IDs are made of, one per possible byte value
+var idWords = [256]string{
+	"acorn", "adobe", "alarm", "album", "amber", "angle", "apple",
+	"apron", "arena", "arrow", "aspen", "atlas", "attic", "bacon",
+	"badge", "bagel", "baker", "bamboo", "banjo", "barn", "basil",
+	"basin", "beach", "beam", "bean", "bear", "bell", "bench", "berry",
+	"bird", "bison", "blade", "blaze", "bloom", "board", "boat", "bolt",
+	"bone", "book", "boot", "brain", "brass", "bread", "brick", "brook",
+	"broom", "brush", "bucket", "bugle", "cabin", "cable", "cactus",
+	"camel", "candy", "canoe", "canvas", "cargo", "carpet", "cedar",
+	"chalk", "charm", "chess", "cider", "cliff", "clock", "cloud",
+	"clover", "coast", "cobra", "cocoa", "comet", "coral", "corn",
+	"cotton", "couch", "crane", "crater", "creek", "crown", "cycle",
+	"daisy", "delta", "denim", "desk", "dingo", "donkey", "dove",
+	"dragon", "drum", "duck", "dune", "eagle", "easel", "echo", "elbow",
+	"ember", "engine", "fable", "falcon", "fern", "ferry", "fiber",
+	"field", "flame", "flute", "foam", "forest", "fossil", "frog",
+	"frost", "gate", "gecko", "ghost", "giant", "ginger", "glass",
+	"globe", "glove", "goat", "gold", "goose", "grape", "grass", "gravel",
+	"hammer", "harbor", "hawk", "hazel", "heron", "hill", "honey",
+	"horse", "hotel", "igloo", "iris", "iron", "island", "ivory",
+	"jacket", "jade", "jelly", "jewel", "jungle", "kayak", "kettle",
+	"kiwi", "koala", "ladder", "lake", "lamp", "lemon", "lever", "lily",
+	"linen", "lion", "llama", "lotus", "lunar", "magnet", "mango",
+	"maple", "marble", "meadow", "melon", "mint", "mirror", "moose",
+	"moss", "motor", "mule", "nectar", "needle", "nest", "noodle",
+	"oasis", "ocean", "olive", "onion", "opal", "orbit", "otter",
+	"oyster", "paddle", "palm", "panda", "paper", "parrot", "peach",
+	"pearl", "pebble", "pepper", "piano", "pigeon", "pillow", "pine",
+	"pixel", "planet", "plum", "pond", "poppy", "prism", "puma", "quartz",
+	"quill", "rabbit", "radar", "raven", "reef", "ribbon", "river",
+	"robin", "rocket", "rose", "ruby", "saddle", "salmon", "sand",
+	"satin", "scarf", "shark", "shell", "silk", "silver", "sloth", "snow",
+	"spark", "spider", "spoon", "squid", "star", "stone", "storm",
+	"sugar", "swan", "table", "tango", "tiger", "toast", "tomato",
+	"torch", "tulip", "tundra", "turtle", "twig", "valley", "velvet",
+	"violin", "wagon", "walnut", "whale", "wheat", "willow", "window",
+	"wolf", "yarn", "zebra",
+}
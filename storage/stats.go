@@ -5,6 +5,7 @@ package storage
 
 import (
 	"errors"
+	"io"
 	"sync"
 )
 
@@ -16,23 +17,61 @@ var (
 	ErrReachedMaxStorage = errors.New("reached maximum storage of pastes")
 )
 
+// Stats keeps track of the number of pastes and the storage they use,
+// enforcing limits on them. Once in use, the limits must be changed via
+// SetLimits.
 type Stats struct {
 	number, MaxNumber   int
 	storage, MaxStorage int64
 	sync.RWMutex
+
+	// Evict, if set, is called to delete an existing paste whenever a
+	// limit would be exceeded. It must free the paste's space.
+	Evict func() error
 }
 
 func (s *Stats) MakeSpaceFor(size int64) error {
+	return s.makeSpace(size, true)
+}
+
+// Grow accounts for size more bytes being used by a paste that was already
+// accounted for via MakeSpaceFor.
+func (s *Stats) Grow(size int64) error {
+	return s.makeSpace(size, false)
+}
+
+func (s *Stats) makeSpace(size int64, newPaste bool) error {
 	s.Lock()
 	defer s.Unlock()
-	if s.MaxNumber > 0 && s.number >= s.MaxNumber {
+	for {
+		err := s.checkLimits(size, newPaste)
+		if err == nil {
+			break
+		}
+		if s.Evict == nil {
+			return err
+		}
+		s.Unlock()
+		evictErr := s.Evict()
+		s.Lock()
+		if evictErr != nil {
+			return err
+		}
+	}
+	if newPaste {
+		s.number++
+	}
+	s.storage += size
+	return nil
+}
+
+func (s *Stats) checkLimits(size int64, newPaste bool) error {
+	if newPaste && s.MaxNumber > 0 && s.number >= s.MaxNumber {
 		return ErrReachedMaxNumber
 	}
 	if s.MaxStorage > 0 && s.storage+size > s.MaxStorage {
 		return ErrReachedMaxStorage
 	}
-	s.number++
-	s.storage += size
 	return nil
 }
 
@@ -43,6 +82,24 @@ func (s *Stats) FreeSpace(size int64) {
 	s.Unlock()
 }
 
+// SetLimits replaces the limits on the number of pastes and the storage
+// they use. Pastes already accounted for are kept even if they exceed the
+// new limits.
+func (s *Stats) SetLimits(maxNumber int, maxStorage int64) {
+	s.Lock()
+	s.MaxNumber = maxNumber
+	s.MaxStorage = maxStorage
+	s.Unlock()
+}
+
+// Limits returns the limits on the number of pastes and the storage they
+// use.
+func (s *Stats) Limits() (int, int64) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.MaxNumber, s.MaxStorage
+}
+
 func (s *Stats) Report() (int, int64) {
 	s.RLock()
 	number := s.number
@@ -50,3 +107,20 @@ func (s *Stats) Report() (int, int64) {
 	s.RUnlock()
 	return number, storage
 }
+
+// statsWriter accounts for every byte written to w in stats before writing
+// it, failing once the maximum storage would be exceeded.
+type statsWriter struct {
+	w     io.Writer
+	stats *Stats
+	// number of bytes accounted for so far
+	n int64
+}
+
+func (sw *statsWriter) Write(p []byte) (int, error) {
+	if err := sw.stats.Grow(int64(len(p))); err != nil {
+		return 0, err
+	}
+	sw.n += int64(len(p))
+	return sw.w.Write(p)
+}
@@ -29,7 +29,7 @@ func TestMakeSpaceFor(t *testing.T) {
 		}
 		got := stats.MakeSpaceFor(c.inSize)
 		if got != c.want {
-			t.Errorf(`%+v.MakeSpaceFor(%v) didn't error as expected.`, stats, c.inSize)
+			t.Errorf(`%+v.MakeSpaceFor(%v) didn't error as expected.`, &stats, c.inSize)
 		}
 	}
 }
@@ -56,3 +56,24 @@ func TestSpaceChanges(t *testing.T) {
 	mustSucceed(stats.MakeSpaceFor(15))
 	mustError(stats.MakeSpaceFor(15))
 }
+
+func TestSetLimits(t *testing.T) {
+	stats := Stats{MaxNumber: 2, MaxStorage: 20}
+	if err := stats.MakeSpaceFor(10); err != nil {
+		t.Fatalf("MakeSpaceFor errored unexpectedly: %v", err)
+	}
+	stats.SetLimits(1, 5)
+	if number, storage := stats.Limits(); number != 1 || storage != 5 {
+		t.Errorf("Limits got %d and %d, want 1 and 5", number, storage)
+	}
+	if got, _ := stats.Report(); got != 1 {
+		t.Errorf("SetLimits dropped the paste already accounted for")
+	}
+	if err := stats.MakeSpaceFor(1); err != ErrReachedMaxNumber {
+		t.Errorf("MakeSpaceFor got error %v, want %v", err, ErrReachedMaxNumber)
+	}
+	stats.SetLimits(0, 0)
+	if err := stats.MakeSpaceFor(100); err != nil {
+		t.Errorf("MakeSpaceFor errored after lifting the limits: %v", err)
+	}
+}
@@ -4,24 +4,30 @@
 package storage
 
 import (
+	"crypto/pbkdf2"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	// Length of the random hexadecimal ids assigned to pastes. At least 4.
-	idSize = 8
-	// Number of times to try getting an unused random paste id
-	randTries = 10
-	// Number of times times to retry deleting a paste
-	deleteRetries = 5
-	// How long to wait before retrying to delete a paste
-	deleteRetryTimeout = 1 * time.Minute
+	// Number of random bytes in the tokens that allow deleting pastes
+	tokenSize = 16
+	// Scheme of the password hashes, followed by the number of iterations,
+	// the salt and the hash itself
+	passwordScheme = "pbkdf2-sha256"
+	// Iterations of PBKDF2 for new password hashes, to make guessing the
+	// passwords from them slow
+	passwordIter = 600000
+	// Number of random bytes in the salt of password hashes
+	saltSize = 16
 )
 
 var (
@@ -30,6 +36,16 @@ var (
 	// ErrNoUnusedIDFound means that we could not find an unused ID to
 	// allocate to a new paste
 	ErrNoUnusedIDFound = errors.New("gave up trying to find an unused random id")
+	// ErrEmptyPaste means that the content given for a new paste was empty
+	ErrEmptyPaste = errors.New("no paste provided")
+	// ErrStoreClosed means that the store was used after being closed
+	ErrStoreClosed = errors.New("store is closed")
+	// ErrNameTaken means that a new paste was given a name that another
+	// paste has already
+	ErrNameTaken = errors.New("paste name is already taken")
+	// ErrNamesUnsupported means that a new paste was given a name, but
+	// the store cannot put pastes under names
+	ErrNamesUnsupported = errors.New("store does not support paste names")
 )
 
 // A Paste represents the paste's content and information
@@ -40,27 +56,126 @@ type Paste interface {
 	io.Closer
 	ModTime() time.Time
 	Size() int64
+	Metadata() Metadata
 }
 
-// ID is the binary representation of the identifier for a paste
-type ID [idSize / 2]byte
+// Metadata holds the information about a paste that is given when putting
+// it and kept along with its content. Stores persist it as a whole, so new
+// fields can be added freely.
+type Metadata struct {
+	// When the paste is to be deleted. Zero means never.
+	Expires time.Time `json:"expires"`
+	// Whether the paste is to be deleted once it has been read
+	Burn bool `json:"burn,omitempty"`
+	// Name of the file the paste was uploaded as, if any
+	Filename string `json:"filename,omitempty"`
+	// Hexadecimal SHA-256 hash of the token that allows deleting the
+	// paste. Empty means that it can only expire.
+	DeleteHash string `json:"delete_hash,omitempty"`
+	// Hash of the password required to read the paste, as given by
+	// HashPassword. Empty means that anyone can read it.
+	PasswordHash string `json:"password_hash,omitempty"`
+	// Content type declared by the uploader, if any
+	ContentType string `json:"content_type,omitempty"`
+	// Address of the client that uploaded the paste
+	Uploader string `json:"uploader,omitempty"`
+	// Custom headers given by the uploader, to be served along with the
+	// paste. Must not be modified once the paste has been put.
+	Header map[string]string `json:"header,omitempty"`
+	// Number of times the paste has been read
+	Views int64 `json:"views,omitempty"`
+	// Whether the content was encrypted by the uploader, so that it can
+	// only be read by the ones given the key
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Hexadecimal SHA-256 hash of the content, kept on the pastes that
+	// hold content shared by others
+	Digest string `json:"digest,omitempty"`
+	// ID of the paste holding the content, kept on the pastes that share
+	// it with others
+	Blob string `json:"blob,omitempty"`
+	// Content coding the content is kept in, such as "gzip", if any
+	Encoding string `json:"encoding,omitempty"`
+	// Size of the content once decoded
+	DecodedSize int64 `json:"decoded_size,omitempty"`
+	// Offsets at which each chunk of the encoded content starts
+	Chunks []int64 `json:"chunks,omitempty"`
+	// ID of the key the content is encrypted with, if any
+	KeyID string `json:"key_id,omitempty"`
+	// Hexadecimal random salt that the key of the content is derived
+	// from
+	Nonce string `json:"nonce,omitempty"`
+}
 
-// IDFromString parses a hexadecimal string into an ID. Returns the ID and an
-// error, if any.
-func IDFromString(hexID string) (id ID, err error) {
-	if len(hexID) != idSize {
-		return id, fmt.Errorf("invalid id at %s", hexID)
+// NewDeleteToken returns a new random token that allows deleting a paste,
+// along with the hash of it to be kept in its metadata.
+func NewDeleteToken() (token, hash string, err error) {
+	b := make([]byte, tokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
 	}
-	b, err := hex.DecodeString(hexID)
-	if err != nil || len(b) != idSize/2 {
-		return id, fmt.Errorf("invalid id at %s", hexID)
+	token = hex.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckDeleteToken reports whether token allows deleting the paste. The
+// comparison takes constant time.
+func (m Metadata) CheckDeleteToken(token string) bool {
+	if m.DeleteHash == "" || token == "" {
+		return false
 	}
-	copy(id[:], b)
-	return id, nil
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(m.DeleteHash)) == 1
+}
+
+// Expired reports whether the paste has expired at the given time. It may
+// still be in its store until its Expirer gets to delete it.
+func (m Metadata) Expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !m.Expires.After(now)
 }
 
-func (id ID) String() string {
-	return hex.EncodeToString(id[:])
+// HashPassword returns the hash of a password required to read a paste, to
+// be kept in its metadata. It uses PBKDF2 with SHA-256 and a random salt,
+// encoding its parameters along with the hash.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIter, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%x$%x", passwordScheme, passwordIter, salt, key), nil
+}
+
+// CheckPassword reports whether password allows reading the paste. The
+// comparison of the hashes takes constant time.
+func (m Metadata) CheckPassword(password string) bool {
+	parts := strings.Split(m.PasswordHash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme || password == "" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < 1 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := hex.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1
 }
 
 // A Store represents a database holding multiple pastes identified by their
@@ -69,52 +184,82 @@ type Store interface {
 	// Get the paste known by the given ID and an error, if any.
 	Get(id ID) (Paste, error)
 
-	// Put a new paste given its content. Will return the ID assigned to
-	// the new paste and an error, if any.
-	Put(content []byte) (ID, error)
+	// Put a new paste reading its content from r until EOF, along with
+	// its metadata. The bytes are accounted for in the store's Stats as
+	// they are written, and its deletion is scheduled in the store's
+	// Expirer. Will return the ID assigned to the new paste and an
+	// error, if any.
+	Put(r io.Reader, meta Metadata) (ID, error)
 
-	// Delete an existing paste by its ID. Will return an error, if any.
+	// Update the metadata of an existing paste by its ID, via f. Changes
+	// to the expiry time are not taken into account. Will return an
+	// error, if any.
+	Update(id ID, f func(*Metadata)) error
+
+	// Delete an existing paste by its ID, freeing the space it used in
+	// the store's Stats and cancelling its deletion in the store's
+	// Expirer. Will return an error, if any.
 	Delete(id ID) error
+
+	// Close the store once the pastes being read are closed, cancelling
+	// the deletions scheduled in the store's Expirer. Persistent stores
+	// keep their pastes for the next time they are opened. Any later use
+	// will return ErrStoreClosed. Will return an error, if any.
+	Close() error
 }
 
-func randomID(available func(ID) bool) (ID, error) {
-	var id ID
-	for try := 0; try < randTries; try++ {
-		if _, err := rand.Read(id[:]); err != nil {
-			continue
-		}
-		if available(id) {
-			return id, nil
-		}
+// A Lister store can list the IDs of all of its pastes
+type Lister interface {
+	Store
+
+	// List returns the IDs of all the pastes in the store.
+	List() ([]ID, error)
+}
+
+// A Namer store can put pastes under names chosen by the uploader
+type Namer interface {
+	Store
+
+	// PutNamed puts a new paste like Put, under the given ID as returned
+	// by NamedID. Will return ErrNameTaken if a paste has that ID already,
+	// and an error, if any.
+	PutNamed(id ID, r io.Reader, meta Metadata) error
+}
+
+var errNotNamed = errors.New("id does not hold a name")
+
+// putIn puts a new paste in s, under id if given or under a random ID
+// otherwise. Returns the ID of the new paste and an error, if any.
+func putIn(s Store, id ID, r io.Reader, meta Metadata) (ID, error) {
+	if id == "" {
+		return s.Put(r, meta)
+	}
+	n, ok := s.(Namer)
+	if !ok {
+		return "", ErrNamesUnsupported
 	}
-	return id, ErrNoUnusedIDFound
+	if err := n.PutNamed(id, r, meta); err != nil {
+		return "", err
+	}
+	return id, nil
 }
 
-func SetupPasteDeletion(s Store, stats *Stats, id ID, size int64, after time.Duration) {
-	if after == 0 {
-		return
+// writePaste copies the content of a new paste from r into w, accounting
+// for it in stats as it goes. If anything fails, all the space accounted
+// is freed again. Returns the number of bytes written and an error, if
+// any.
+func writePaste(w io.Writer, r io.Reader, stats *Stats) (int64, error) {
+	if err := stats.MakeSpaceFor(0); err != nil {
+		return 0, err
+	}
+	sw := &statsWriter{w: w, stats: stats}
+	if _, err := io.Copy(sw, r); err != nil {
+		stats.FreeSpace(sw.n)
+		return 0, err
 	}
-	f := func() {
-		del := func() error {
-			if err := s.Delete(id); err != nil {
-				return err
-			}
-			stats.FreeSpace(size)
-			return nil
-		}
-		if err := del(); err == nil {
-			return
-		}
-		timer := time.NewTimer(deleteRetryTimeout)
-		for i := 0; i < deleteRetries; i++ {
-			log.Printf("Could not delete %s, trying again in %s", id, deleteRetryTimeout)
-			<-timer.C
-			if err := del(); err == nil {
-				break
-			}
-			timer.Reset(deleteRetryTimeout)
-		}
-		log.Printf("Giving up on deleting %s", id)
+	if sw.n == 0 {
+		stats.FreeSpace(0)
+		return 0, ErrEmptyPaste
 	}
-	time.AfterFunc(after, f)
+	return sw.n, nil
 }
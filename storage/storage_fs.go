@@ -5,31 +5,54 @@ package storage
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// Prefix of the temporary files that new pastes are written to before
+	// being moved into place
+	tempPrefix = ".tmp-"
+	// Suffix of the files holding the metadata of each paste, next to
+	// the files holding their content
+	metaSuffix = ".meta"
+)
+
 type FileStore struct {
 	sync.RWMutex
-	cache map[ID]fileCache
-	dir   string
+	cache   map[ID]*fileCache
+	dir     string
+	stats   *Stats
+	expirer *Expirer
+	index   *expiryIndex
+	closed  bool
 }
 
 type fileCache struct {
 	path    string
 	modTime time.Time
 	size    int64
+	meta    *lazyMeta
 	reading sync.WaitGroup
+	// number of readers, to tell whether reading is done without waiting
+	readers atomic.Int32
+	// unix time in nanoseconds of the last time it was read
+	lastRead atomic.Int64
 }
 
 type FilePaste struct {
 	file  *os.File
 	cache *fileCache
+	// snapshot of the metadata when it was got
+	meta Metadata
 }
 
 func (c FilePaste) Read(p []byte) (n int, err error) {
@@ -46,6 +69,7 @@ func (c FilePaste) Seek(offset int64, whence int) (int64, error) {
 
 func (c FilePaste) Close() error {
 	err := c.file.Close()
+	c.cache.readers.Add(-1)
 	c.cache.reading.Done()
 	return err
 }
@@ -54,24 +78,35 @@ func (c FilePaste) ModTime() time.Time { return c.cache.modTime }
 
 func (c FilePaste) Size() int64 { return c.cache.size }
 
-func NewFileStore(stats *Stats, lifeTime time.Duration, dir string) (*FileStore, error) {
-	if err := setupTopDir(dir); err != nil {
+func (c FilePaste) Metadata() Metadata { return c.meta }
+
+func NewFileStore(stats *Stats, expirer *Expirer, lifeTime time.Duration, dir string) (*FileStore, error) {
+	dir, err := setupTopDir(dir)
+	if err != nil {
 		return nil, err
 	}
 	s := new(FileStore)
 	s.dir = dir
-	s.cache = make(map[ID]fileCache)
+	s.cache = make(map[ID]*fileCache)
+	s.stats = stats
+	s.expirer = expirer
+	if s.index, err = readExpiryIndex(s.dir); err != nil {
+		return nil, err
+	}
 
-	insert := func(id ID, path string, modTime time.Time, size int64) error {
-		cached := fileCache{
+	insert := func(id ID, path string, modTime time.Time, size int64, meta *lazyMeta) error {
+		s.cache[id] = &fileCache{
 			path:    path,
 			size:    size,
 			modTime: modTime,
+			meta:    meta,
 		}
-		s.cache[id] = cached
 		return nil
 	}
-	if err := setupSubdirs(s.dir, fileRecover(insert, s, stats, lifeTime)); err != nil {
+	if err := setupSubdirs(s.dir, fileRecover(s.dir, insert, s, stats, expirer, s.index, lifeTime)); err != nil {
+		return nil, err
+	}
+	if err := s.index.open(); err != nil {
 		return nil, err
 	}
 	return s, nil
@@ -80,148 +115,526 @@ func NewFileStore(stats *Stats, lifeTime time.Duration, dir string) (*FileStore,
 func (s *FileStore) Get(id ID) (Paste, error) {
 	s.RLock()
 	defer s.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
 	cached, e := s.cache[id]
 	if !e {
 		return nil, ErrPasteNotFound
 	}
+	meta, err := cached.meta.get(cached.path)
+	if err != nil {
+		return nil, err
+	}
 	f, err := os.Open(cached.path)
 	if err != nil {
 		return nil, err
 	}
 	cached.reading.Add(1)
-	return FilePaste{file: f, cache: &cached}, nil
+	cached.readers.Add(1)
+	cached.lastRead.Store(time.Now().UnixNano())
+	return FilePaste{file: f, cache: cached, meta: meta}, nil
+}
+
+// tempPaste is a new paste whose content and metadata have been written to
+// temporary files, but which has not been given an ID yet
+type tempPaste struct {
+	path, metaPath string
+	size           int64
+	expires        time.Time
+	stats          *Stats
+}
+
+// writeTempPaste writes the content of a new paste read from r and its
+// metadata into new temporary files, accounting for the content in stats.
+func writeTempPaste(dir string, r io.Reader, meta Metadata, stats *Stats) (*tempPaste, error) {
+	f, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	t := &tempPaste{path: f.Name(), expires: meta.Expires, stats: stats}
+	t.size, err = writePaste(f, r, stats)
+	if err == nil {
+		// make sure that a crash never leaves a truncated paste
+		if err = f.Sync(); err != nil {
+			stats.FreeSpace(t.size)
+		}
+	}
+	if err1 := f.Close(); err == nil && err1 != nil {
+		stats.FreeSpace(t.size)
+		err = err1
+	}
+	if err != nil {
+		os.Remove(t.path)
+		return nil, err
+	}
+	if t.metaPath, err = writeTempMeta(dir, meta); err != nil {
+		t.remove()
+		return nil, err
+	}
+	return t, nil
 }
 
-func writeNewFile(filename string, data []byte) error {
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+// writeMetaFile replaces the metadata file at path atomically, using a
+// temporary file in dir.
+func writeMetaFile(dir, path string, meta Metadata) error {
+	tempPath, err := writeTempMeta(dir, meta)
 	if err != nil {
 		return err
 	}
-	n, err := f.Write(data)
-	if err == nil && n < len(data) {
-		err = io.ErrShortWrite
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+func writeTempMeta(dir string, meta Metadata) (string, error) {
+	f, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return "", err
+	}
+	err = json.NewEncoder(f).Encode(meta)
+	if err == nil {
+		err = f.Sync()
 	}
 	if err1 := f.Close(); err == nil {
 		err = err1
 	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// remove gets rid of the temporary files and frees the space accounted.
+func (t *tempPaste) remove() {
+	os.Remove(t.path)
+	if t.metaPath != "" {
+		os.Remove(t.metaPath)
+	}
+	t.stats.FreeSpace(t.size)
+}
+
+// move puts the temporary files in place in dir under id if it is
+// available, or under an unused random ID if it is empty. The expiry time
+// is added to index and the metadata goes first, so that a crash never
+// leaves a paste without them. If anything fails, the temporary files are
+// removed.
+func (t *tempPaste) move(dir string, id ID, available func(ID) bool, index *expiryIndex) (ID, string, error) {
+	id, err := pickID(id, available)
+	if err == nil {
+		err = index.add(id, t.expires)
+	}
+	var path string
+	if err == nil {
+		path = filepath.Join(dir, pathFromID(id))
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+	}
+	if err == nil {
+		err = os.Rename(t.metaPath, path+metaSuffix)
+	}
+	if err == nil {
+		t.metaPath = ""
+		if err = os.Rename(t.path, path); err != nil {
+			os.Remove(path + metaSuffix)
+		}
+	}
+	if err != nil {
+		t.remove()
+		return id, "", err
+	}
+	return id, path, nil
+}
+
+func (s *FileStore) Put(r io.Reader, meta Metadata) (ID, error) {
+	return s.put("", r, meta)
+}
+
+func (s *FileStore) PutNamed(id ID, r io.Reader, meta Metadata) error {
+	if !id.Named() {
+		return errNotNamed
+	}
+	_, err := s.put(id, r, meta)
 	return err
 }
 
-func (s *FileStore) Put(content []byte) (ID, error) {
-	size := int64(len(content))
+// put puts a new paste under id, or under a random ID if it is empty.
+func (s *FileStore) put(id ID, r io.Reader, meta Metadata) (ID, error) {
+	t, err := writeTempPaste(s.dir, r, meta, s.stats)
+	if err != nil {
+		return "", err
+	}
 	available := func(id ID) bool {
 		_, e := s.cache[id]
 		return !e
 	}
 	s.Lock()
 	defer s.Unlock()
-	id, err := randomID(available)
-	if err != nil {
-		return id, err
+	if s.closed {
+		t.remove()
+		return "", ErrStoreClosed
 	}
-	pastePath := pathFromID(id)
-	if err = writeNewFile(pastePath, content); err != nil {
+	id, path, err := t.move(s.dir, id, available, s.index)
+	if err != nil {
 		return id, err
 	}
-	s.cache[id] = fileCache{
-		path:    pastePath,
-		size:    size,
+	s.cache[id] = &fileCache{
+		path:    path,
+		size:    t.size,
 		modTime: time.Now(),
+		meta:    knownMeta(meta),
 	}
+	s.expirer.Add(s, id, meta.Expires)
 	return id, nil
 }
 
+func (s *FileStore) Update(id ID, f func(*Metadata)) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	cached, e := s.cache[id]
+	if !e {
+		return ErrPasteNotFound
+	}
+	meta, err := cached.meta.get(cached.path)
+	if err != nil {
+		return err
+	}
+	f(&meta)
+	if err := writeMetaFile(s.dir, cached.path+metaSuffix, meta); err != nil {
+		return err
+	}
+	cached.meta.set(meta)
+	return nil
+}
+
 func (s *FileStore) Delete(id ID) error {
+	return s.delete(id, false)
+}
+
+func (s *FileStore) deleteUnlessBusy(id ID) error {
+	return s.delete(id, true)
+}
+
+func (s *FileStore) busy(id ID) bool {
+	s.RLock()
+	defer s.RUnlock()
+	cached, e := s.cache[id]
+	return e && cached.readers.Load() > 0
+}
+
+func (s *FileStore) delete(id ID, unlessBusy bool) error {
 	s.Lock()
 	defer s.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
 	cached, e := s.cache[id]
 	if !e {
 		return ErrPasteNotFound
 	}
+	if unlessBusy && cached.readers.Load() > 0 {
+		return errPasteBusy
+	}
 	cached.reading.Wait()
-	if err := os.Remove(cached.path); err != nil {
+	if err := removePasteFiles(cached.path); err != nil {
 		return err
 	}
 	delete(s.cache, id)
+	s.stats.FreeSpace(cached.size)
+	s.expirer.Remove(s, id)
+	return nil
+}
+
+func (s *FileStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	s.closed = true
+	for id, cached := range s.cache {
+		cached.reading.Wait()
+		s.expirer.Remove(s, id)
+	}
+	return s.index.close()
+}
+
+func (s *FileStore) List() ([]ID, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	ids := make([]ID, 0, len(s.cache))
+	for id := range s.cache {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *FileStore) Victim(policy EvictPolicy) (ID, error) {
+	s.RLock()
+	defer s.RUnlock()
+	v := victim{policy: policy}
+	for id, cached := range s.cache {
+		v.consider(id, cached.modTime, time.Unix(0, cached.lastRead.Load()))
+	}
+	return v.result()
+}
+
+// removePasteFiles removes the content and metadata files of a paste
+func removePasteFiles(path string) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if err := os.Remove(path + metaSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
+// pathFromID returns the path of the paste known by id, relative to the
+// top directory. Its first two characters name the directory it goes in.
+// Upper case letters are escaped, as file names may be case insensitive,
+// along with dots and underscores in names.
 func pathFromID(id ID) string {
-	hexID := id.String()
-	return filepath.Join(hexID[:2], hexID[2:])
+	name := escapeID(id)
+	return filepath.Join(name[:2], name[2:])
 }
 
 func idFromPath(path string) (ID, error) {
 	parts := strings.Split(path, string(filepath.Separator))
 	if len(parts) != 2 {
-		return ID{}, fmt.Errorf("invalid number of directories at %s", path)
+		return "", fmt.Errorf("invalid number of directories at %s", path)
 	}
 	if len(parts[0]) != 2 {
-		return ID{}, fmt.Errorf("invalid directory name length at %s", path)
+		return "", fmt.Errorf("invalid directory name length at %s", path)
 	}
-	hexID := parts[0] + parts[1]
-	return IDFromString(hexID)
+	name := parts[0] + parts[1]
+	id, err := unescapeID(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid id at %s", path)
+	}
+	return id, nil
 }
 
-type fileInsert func(id ID, path string, modTime time.Time, size int64) error
+// escapeID returns the name of the file holding the paste known by id,
+// with each upper case letter written as an underscore followed by the
+// letter in lower case. Dots and underscores are written as an underscore
+// followed by their two hexadecimal digits, so that the name never holds
+// any dots.
+func escapeID(id ID) string {
+	var b strings.Builder
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; {
+		case c >= 'A' && c <= 'Z':
+			b.WriteByte('_')
+			b.WriteByte(c + 'a' - 'A')
+		case c == '.', c == '_':
+			fmt.Fprintf(&b, "_%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
 
-func fileRecover(insert fileInsert, s Store, stats *Stats, lifeTime time.Duration) filepath.WalkFunc {
+func unescapeID(name string) (ID, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c != '_' {
+			b.WriteByte(c)
+			continue
+		}
+		rest := name[i+1:]
+		switch {
+		case len(rest) >= 1 && rest[0] >= 'a' && rest[0] <= 'z':
+			b.WriteByte(rest[0] - ('a' - 'A'))
+			i++
+		case len(rest) >= 2 && rest[0] >= '0' && rest[0] <= '9':
+			h, err := hex.DecodeString(rest[:2])
+			if err != nil {
+				return "", fmt.Errorf("invalid escape in %s", name)
+			}
+			b.WriteByte(h[0])
+			i += 2
+		default:
+			return "", fmt.Errorf("invalid escape in %s", name)
+		}
+	}
+	id, err := IDFromString(b.String())
+	if err != nil || escapeID(id) != name {
+		return "", fmt.Errorf("invalid id at %s", name)
+	}
+	return id, nil
+}
+
+type fileInsert func(id ID, path string, modTime time.Time, size int64, meta *lazyMeta) error
+
+// lazyMeta holds the metadata of a paste in a file store, which is only read
+// from its file the first time it is needed
+type lazyMeta struct {
+	// expiry time, as known before reading the file
+	expires time.Time
+	once    sync.Once
+	meta    Metadata
+	err     error
+}
+
+// knownMeta returns the metadata of a paste that does not need reading.
+func knownMeta(meta Metadata) *lazyMeta {
+	m := &lazyMeta{expires: meta.Expires}
+	m.set(meta)
+	return m
+}
+
+// get returns the metadata of the paste at path, reading it the first time.
+func (m *lazyMeta) get(path string) (Metadata, error) {
+	m.once.Do(func() {
+		m.meta, m.err = readMetaFile(path + metaSuffix)
+		if os.IsNotExist(m.err) {
+			// pastes from before metadata was kept
+			m.meta, m.err = Metadata{Expires: m.expires}, nil
+		}
+	})
+	return m.meta, m.err
+}
+
+// set replaces the metadata. The store must be locked for writing.
+func (m *lazyMeta) set(meta Metadata) {
+	m.once.Do(func() {})
+	m.meta, m.err = meta, nil
+}
+
+func readMetaFile(path string) (Metadata, error) {
+	var meta Metadata
+	f, err := os.Open(path)
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&meta)
+	return meta, err
+}
+
+// fileRecover returns a function to recover each paste in topdir. Their
+// expiry times are taken from index, and only the pastes missing from it
+// have their metadata read. Pastes that have expired already are removed.
+func fileRecover(topdir string, insert fileInsert, s Store, stats *Stats, expirer *Expirer, index *expiryIndex, lifeTime time.Duration) filepath.WalkFunc {
 	startTime := time.Now()
 	return func(path string, fileInfo os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed along with an expired paste
+			return nil
+		}
 		if err != nil || fileInfo.IsDir() {
 			return err
 		}
-		id, err := idFromPath(path)
+		if strings.HasSuffix(path, metaSuffix) {
+			_, err := os.Stat(strings.TrimSuffix(path, metaSuffix))
+			if os.IsNotExist(err) {
+				return os.Remove(path)
+			}
+			return err
+		}
+		relPath, err := filepath.Rel(topdir, path)
+		if err != nil {
+			return err
+		}
+		id, err := idFromPath(relPath)
 		if err != nil {
 			return err
 		}
 		modTime := fileInfo.ModTime()
-		lifeLeft := modTime.Add(lifeTime).Sub(startTime)
-		if lifeTime > 0 && lifeLeft <= 0 {
-			return os.Remove(path)
+		var meta *lazyMeta
+		if expires, ok := index.lookup(id); ok {
+			meta = &lazyMeta{expires: expires}
+		} else {
+			// pastes from before the index was kept
+			m, err := readMetaFile(path + metaSuffix)
+			if os.IsNotExist(err) {
+				// pastes from before metadata was kept
+				if lifeTime > 0 {
+					m.Expires = modTime.Add(lifeTime)
+				}
+			} else if err != nil {
+				return fmt.Errorf("cannot read metadata of %s: %v", path, err)
+			}
+			meta = knownMeta(m)
+		}
+		if !meta.expires.IsZero() && !meta.expires.After(startTime) {
+			return removePasteFiles(path)
 		}
 		size := fileInfo.Size()
 		if size == 0 {
-			return os.Remove(path)
+			return removePasteFiles(path)
 		}
 		if err := stats.MakeSpaceFor(size); err != nil {
 			return err
 		}
-		if err := insert(id, path, modTime, size); err != nil {
+		if err := insert(id, path, modTime, size, meta); err != nil {
 			return err
 		}
-		SetupPasteDeletion(s, stats, id, size, lifeLeft)
+		index.recovered(id, meta.expires)
+		expirer.Add(s, id, meta.expires)
 		return nil
 	}
 }
 
-func setupTopDir(topdir string) error {
+// setupTopDir creates topdir if needed, returning its absolute path. Any
+// temporary files left in it by a previous run are removed.
+func setupTopDir(topdir string) (string, error) {
 	if err := os.MkdirAll(topdir, 0700); err != nil {
-		return err
+		return "", err
 	}
-	return os.Chdir(topdir)
+	temps, err := filepath.Glob(filepath.Join(topdir, tempPrefix+"*"))
+	if err != nil {
+		return "", err
+	}
+	for _, path := range temps {
+		if err := os.Remove(path); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Abs(topdir)
 }
 
+// setupSubdirs recovers the pastes in the directories under topdir, which
+// are named after the first two characters of the IDs in them. Any other
+// files and directories are left alone.
 func setupSubdirs(topdir string, rec filepath.WalkFunc) error {
-	for i := 0; i < 256; i++ {
-		if err := setupSubdir(topdir, rec, byte(i)); err != nil {
-			return err
+	entries, err := ioutil.ReadDir(topdir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		dir := entry.Name()
+		if !entry.IsDir() || !isSubdirName(dir) {
+			continue
+		}
+		if err := filepath.Walk(filepath.Join(topdir, dir), rec); err != nil {
+			return fmt.Errorf("cannot recover data directory %s/%s: %v", topdir, dir, err)
 		}
 	}
 	return nil
 }
 
-func setupSubdir(topdir string, rec filepath.WalkFunc, h byte) error {
-	dir := hex.EncodeToString([]byte{h})
-	if stat, err := os.Stat(dir); err == nil {
-		if !stat.IsDir() {
-			return fmt.Errorf("%s/%s exists but is not a directory", topdir, dir)
-		}
-		if err := filepath.Walk(dir, rec); err != nil {
-			return fmt.Errorf("cannot recover data directory %s/%s: %v", topdir, dir, err)
+// isSubdirName reports whether name could be the start of an escaped ID.
+func isSubdirName(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || strings.IndexByte("_-~", c) >= 0) {
+			return false
 		}
-	} else if err := os.Mkdir(dir, 0700); err != nil {
-		return fmt.Errorf("cannot create data directory %s/%s: %v", topdir, dir, err)
 	}
-	return nil
+	return true
 }
@@ -0,0 +1,135 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name of the file in the top directory of the file stores that holds the
+// expiry times of their pastes
+const expiryIndexName = "expiry.index"
+
+// An expiryIndex keeps the expiry times of the pastes of a file store on
+// disk, so that their deletions can be scheduled again when it is opened
+// without reading the metadata of each paste. The file has a line per paste
+// put, holding the time in unix nanoseconds, or zero if it never expires,
+// followed by the ID. Later lines take precedence, and the file is
+// rewritten with just the pastes found every time the store is opened.
+type expiryIndex struct {
+	path string
+	file *os.File
+	// times read from the file and times of the pastes found, only used
+	// while recovering
+	read, found map[ID]time.Time
+}
+
+// readExpiryIndex reads the index in dir, if there is one, to recover the
+// pastes in dir with it.
+func readExpiryIndex(dir string) (*expiryIndex, error) {
+	x := &expiryIndex{
+		path:  filepath.Join(dir, expiryIndexName),
+		read:  make(map[ID]time.Time),
+		found: make(map[ID]time.Time),
+	}
+	data, err := ioutil.ReadFile(x.path)
+	if os.IsNotExist(err) {
+		return x, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	// the last one is either empty or cut short by a crash
+	for _, line := range lines[:len(lines)-1] {
+		nanos, rawID, _ := strings.Cut(line, " ")
+		n, err := strconv.ParseInt(nanos, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line in %s: %q", x.path, line)
+		}
+		id, err := IDFromString(rawID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line in %s: %q", x.path, line)
+		}
+		var at time.Time
+		if n != 0 {
+			at = time.Unix(0, n)
+		}
+		x.read[id] = at
+	}
+	return x, nil
+}
+
+// lookup returns the expiry time of the paste known by id as read from the
+// file, and whether it was in it at all.
+func (x *expiryIndex) lookup(id ID) (time.Time, bool) {
+	at, ok := x.read[id]
+	return at, ok
+}
+
+// recovered records that the paste known by id was found, expiring at the
+// given time.
+func (x *expiryIndex) recovered(id ID, at time.Time) {
+	x.found[id] = at
+}
+
+// open replaces the file with one holding the pastes found, and opens it
+// for the pastes put from then on.
+func (x *expiryIndex) open() error {
+	f, err := ioutil.TempFile(filepath.Dir(x.path), tempPrefix)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for id, at := range x.found {
+		writeIndexLine(w, id, at)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), x.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	x.read, x.found = nil, nil
+	x.file, err = os.OpenFile(x.path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// add records that the paste known by id expires at the given time, before
+// it is put.
+func (x *expiryIndex) add(id ID, at time.Time) error {
+	if err := writeIndexLine(x.file, id, at); err != nil {
+		return err
+	}
+	return x.file.Sync()
+}
+
+func (x *expiryIndex) close() error {
+	return x.file.Close()
+}
+
+func writeIndexLine(w io.Writer, id ID, at time.Time) error {
+	var nanos int64
+	if !at.IsZero() {
+		nanos = at.UnixNano()
+	}
+	_, err := fmt.Fprintf(w, "%d %s\n", nanos, id)
+	return err
+}
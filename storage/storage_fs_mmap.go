@@ -5,8 +5,10 @@ package storage
 
 import (
 	"bytes"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	memmap "github.com/edsrzf/mmap-go"
@@ -14,21 +16,32 @@ import (
 
 type MmapStore struct {
 	sync.RWMutex
-	cache map[ID]mmapCache
-	dir   string
+	cache   map[ID]*mmapCache
+	dir     string
+	stats   *Stats
+	expirer *Expirer
+	index   *expiryIndex
+	closed  bool
 }
 
 type mmapCache struct {
 	reading sync.WaitGroup
+	// number of readers, to tell whether reading is done without waiting
+	readers atomic.Int32
 	modTime time.Time
 	path    string
 	mmap    memmap.MMap
 	size    int64
+	meta    *lazyMeta
+	// unix time in nanoseconds of the last time it was read
+	lastRead atomic.Int64
 }
 
 type MmapPaste struct {
 	content *bytes.Reader
 	cache   *mmapCache
+	// snapshot of the metadata when it was got
+	meta Metadata
 }
 
 func (c MmapPaste) Read(p []byte) (n int, err error) {
@@ -44,6 +57,7 @@ func (c MmapPaste) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (c MmapPaste) Close() error {
+	c.cache.readers.Add(-1)
 	c.cache.reading.Done()
 	return nil
 }
@@ -52,31 +66,40 @@ func (c MmapPaste) ModTime() time.Time { return c.cache.modTime }
 
 func (c MmapPaste) Size() int64 { return c.cache.size }
 
-func NewMmapStore(stats *Stats, lifeTime time.Duration, dir string) (*MmapStore, error) {
-	if err := setupTopDir(dir); err != nil {
+func (c MmapPaste) Metadata() Metadata { return c.meta }
+
+func NewMmapStore(stats *Stats, expirer *Expirer, lifeTime time.Duration, dir string) (*MmapStore, error) {
+	dir, err := setupTopDir(dir)
+	if err != nil {
 		return nil, err
 	}
 	s := new(MmapStore)
 	s.dir = dir
-	s.cache = make(map[ID]mmapCache)
+	s.cache = make(map[ID]*mmapCache)
+	s.stats = stats
+	s.expirer = expirer
+	if s.index, err = readExpiryIndex(s.dir); err != nil {
+		return nil, err
+	}
 
-	insert := func(id ID, path string, modTime time.Time, size int64) error {
-		f, err := os.Open(path)
-		defer f.Close()
-		mmap, err := getMmap(f)
+	insert := func(id ID, path string, modTime time.Time, size int64, meta *lazyMeta) error {
+		mmap, err := mmapFile(path)
 		if err != nil {
 			return err
 		}
-		cached := mmapCache{
+		s.cache[id] = &mmapCache{
 			modTime: modTime,
 			path:    path,
 			mmap:    mmap,
 			size:    size,
+			meta:    meta,
 		}
-		s.cache[id] = cached
 		return nil
 	}
-	if err := setupSubdirs(s.dir, fileRecover(insert, s, stats, lifeTime)); err != nil {
+	if err := setupSubdirs(s.dir, fileRecover(s.dir, insert, s, stats, expirer, s.index, lifeTime)); err != nil {
+		return nil, err
+	}
+	if err := s.index.open(); err != nil {
 		return nil, err
 	}
 	return s, nil
@@ -85,55 +108,126 @@ func NewMmapStore(stats *Stats, lifeTime time.Duration, dir string) (*MmapStore,
 func (s *MmapStore) Get(id ID) (Paste, error) {
 	s.RLock()
 	defer s.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
 	cached, e := s.cache[id]
 	if !e {
 		return nil, ErrPasteNotFound
 	}
+	meta, err := cached.meta.get(cached.path)
+	if err != nil {
+		return nil, err
+	}
 	reader := bytes.NewReader(cached.mmap)
 	cached.reading.Add(1)
-	return MmapPaste{content: reader, cache: &cached}, nil
+	cached.readers.Add(1)
+	cached.lastRead.Store(time.Now().UnixNano())
+	return MmapPaste{content: reader, cache: cached, meta: meta}, nil
+}
+
+func (s *MmapStore) Put(r io.Reader, meta Metadata) (ID, error) {
+	return s.put("", r, meta)
+}
+
+func (s *MmapStore) PutNamed(id ID, r io.Reader, meta Metadata) error {
+	if !id.Named() {
+		return errNotNamed
+	}
+	_, err := s.put(id, r, meta)
+	return err
 }
 
-func (s *MmapStore) Put(content []byte) (ID, error) {
-	size := int64(len(content))
+// put puts a new paste under id, or under a random ID if it is empty.
+func (s *MmapStore) put(id ID, r io.Reader, meta Metadata) (ID, error) {
+	t, err := writeTempPaste(s.dir, r, meta, s.stats)
+	if err != nil {
+		return "", err
+	}
 	available := func(id ID) bool {
 		_, e := s.cache[id]
 		return !e
 	}
 	s.Lock()
 	defer s.Unlock()
-	id, err := randomID(available)
-	if err != nil {
-		return id, err
+	if s.closed {
+		t.remove()
+		return "", ErrStoreClosed
 	}
-	path := pathFromID(id)
-	if err = writeNewFile(path, content); err != nil {
+	id, path, err := t.move(s.dir, id, available, s.index)
+	if err != nil {
 		return id, err
 	}
-	f, err := os.Open(path)
-	mmap, err := getMmap(f)
+	mmap, err := mmapFile(path)
 	if err != nil {
+		removePasteFiles(path)
+		s.stats.FreeSpace(t.size)
 		return id, err
 	}
-	s.cache[id] = mmapCache{
+	s.cache[id] = &mmapCache{
 		path:    path,
 		modTime: time.Now(),
-		size:    size,
+		size:    t.size,
 		mmap:    mmap,
+		meta:    knownMeta(meta),
 	}
+	s.expirer.Add(s, id, meta.Expires)
 	return id, nil
 }
 
+func (s *MmapStore) Update(id ID, f func(*Metadata)) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	cached, e := s.cache[id]
+	if !e {
+		return ErrPasteNotFound
+	}
+	meta, err := cached.meta.get(cached.path)
+	if err != nil {
+		return err
+	}
+	f(&meta)
+	if err := writeMetaFile(s.dir, cached.path+metaSuffix, meta); err != nil {
+		return err
+	}
+	cached.meta.set(meta)
+	return nil
+}
+
 func (s *MmapStore) Delete(id ID) error {
+	return s.delete(id, false)
+}
+
+func (s *MmapStore) deleteUnlessBusy(id ID) error {
+	return s.delete(id, true)
+}
+
+func (s *MmapStore) busy(id ID) bool {
+	s.RLock()
+	defer s.RUnlock()
+	cached, e := s.cache[id]
+	return e && cached.readers.Load() > 0
+}
+
+func (s *MmapStore) delete(id ID, unlessBusy bool) error {
 	s.Lock()
 	defer s.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
 	cached, e := s.cache[id]
 	if !e {
 		return ErrPasteNotFound
 	}
+	if unlessBusy && cached.readers.Load() > 0 {
+		return errPasteBusy
+	}
 	cached.reading.Wait()
 	err1 := cached.mmap.Unmap()
-	err2 := os.Remove(cached.path)
+	err2 := removePasteFiles(cached.path)
 	if err1 != nil {
 		return err1
 	}
@@ -141,9 +235,60 @@ func (s *MmapStore) Delete(id ID) error {
 		return err2
 	}
 	delete(s.cache, id)
+	s.stats.FreeSpace(cached.size)
+	s.expirer.Remove(s, id)
 	return nil
 }
 
-func getMmap(f *os.File) (memmap.MMap, error) {
+func (s *MmapStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	s.closed = true
+	var err error
+	for id, cached := range s.cache {
+		cached.reading.Wait()
+		if err1 := cached.mmap.Unmap(); err == nil {
+			err = err1
+		}
+		s.expirer.Remove(s, id)
+	}
+	if err1 := s.index.close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (s *MmapStore) List() ([]ID, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	ids := make([]ID, 0, len(s.cache))
+	for id := range s.cache {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *MmapStore) Victim(policy EvictPolicy) (ID, error) {
+	s.RLock()
+	defer s.RUnlock()
+	v := victim{policy: policy}
+	for id, cached := range s.cache {
+		v.consider(id, cached.modTime, time.Unix(0, cached.lastRead.Load()))
+	}
+	return v.result()
+}
+
+func mmapFile(path string) (memmap.MMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 	return memmap.Map(f, memmap.RDONLY, 0)
 }
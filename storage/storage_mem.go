@@ -5,24 +5,34 @@ package storage
 
 import (
 	"bytes"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type MemStore struct {
 	sync.RWMutex
-	cache map[ID]memCache
+	cache   map[ID]*memCache
+	stats   *Stats
+	expirer *Expirer
+	closed  bool
 }
 
 type memCache struct {
 	buffer  []byte
 	modTime time.Time
 	size    int64
+	meta    Metadata
+	// unix time in nanoseconds of the last time it was read
+	lastRead atomic.Int64
 }
 
 type MemPaste struct {
 	content *bytes.Reader
 	cache   *memCache
+	// snapshot of the metadata when it was got
+	meta Metadata
 }
 
 func (ps MemPaste) Read(p []byte) (n int, err error) {
@@ -43,50 +53,137 @@ func (ps MemPaste) ModTime() time.Time { return ps.cache.modTime }
 
 func (ps MemPaste) Size() int64 { return ps.cache.size }
 
-func NewMemStore() (s *MemStore, err error) {
+func (ps MemPaste) Metadata() Metadata { return ps.meta }
+
+func NewMemStore(stats *Stats, expirer *Expirer) (s *MemStore, err error) {
 	s = new(MemStore)
-	s.cache = make(map[ID]memCache)
+	s.cache = make(map[ID]*memCache)
+	s.stats = stats
+	s.expirer = expirer
 	return
 }
 
 func (s *MemStore) Get(id ID) (Paste, error) {
 	s.RLock()
 	defer s.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
 	cached, e := s.cache[id]
 	if !e {
 		return nil, ErrPasteNotFound
 	}
 	reader := bytes.NewReader(cached.buffer)
-	return MemPaste{content: reader, cache: &cached}, nil
+	cached.lastRead.Store(time.Now().UnixNano())
+	return MemPaste{content: reader, cache: cached, meta: cached.meta}, nil
+}
+
+func (s *MemStore) Put(r io.Reader, meta Metadata) (ID, error) {
+	return s.put("", r, meta)
+}
+
+func (s *MemStore) PutNamed(id ID, r io.Reader, meta Metadata) error {
+	if !id.Named() {
+		return errNotNamed
+	}
+	_, err := s.put(id, r, meta)
+	return err
 }
 
-func (s *MemStore) Put(content []byte) (ID, error) {
-	size := int64(len(content))
+// put puts a new paste under id, or under a random ID if it is empty.
+func (s *MemStore) put(id ID, r io.Reader, meta Metadata) (ID, error) {
+	var buf bytes.Buffer
+	size, err := writePaste(&buf, r, s.stats)
+	if err != nil {
+		return "", err
+	}
 	available := func(id ID) bool {
 		_, e := s.cache[id]
 		return !e
 	}
 	s.Lock()
 	defer s.Unlock()
-	id, err := randomID(available)
+	if s.closed {
+		s.stats.FreeSpace(size)
+		return "", ErrStoreClosed
+	}
+	id, err = pickID(id, available)
 	if err != nil {
+		s.stats.FreeSpace(size)
 		return id, err
 	}
-	s.cache[id] = memCache{
-		buffer:  content,
+	s.cache[id] = &memCache{
+		buffer:  buf.Bytes(),
 		modTime: time.Now(),
 		size:    size,
+		meta:    meta,
 	}
+	s.expirer.Add(s, id, meta.Expires)
 	return id, nil
 }
 
+func (s *MemStore) Update(id ID, f func(*Metadata)) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	cached, e := s.cache[id]
+	if !e {
+		return ErrPasteNotFound
+	}
+	f(&cached.meta)
+	return nil
+}
+
 func (s *MemStore) Delete(id ID) error {
 	s.Lock()
 	defer s.Unlock()
-	_, e := s.cache[id]
+	if s.closed {
+		return ErrStoreClosed
+	}
+	cached, e := s.cache[id]
 	if !e {
 		return ErrPasteNotFound
 	}
 	delete(s.cache, id)
+	s.stats.FreeSpace(cached.size)
+	s.expirer.Remove(s, id)
+	return nil
+}
+
+func (s *MemStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	s.closed = true
+	for id := range s.cache {
+		s.expirer.Remove(s, id)
+	}
 	return nil
 }
+
+func (s *MemStore) List() ([]ID, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	ids := make([]ID, 0, len(s.cache))
+	for id := range s.cache {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *MemStore) Victim(policy EvictPolicy) (ID, error) {
+	s.RLock()
+	defer s.RUnlock()
+	v := victim{policy: policy}
+	for id, cached := range s.cache {
+		v.consider(id, cached.modTime, time.Unix(0, cached.lastRead.Load()))
+	}
+	return v.result()
+}
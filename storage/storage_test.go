@@ -1,36 +1,40 @@
 package storage
 
 import (
-	"bytes"
-	"reflect"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 )
 
-func strRepeat(s string) string {
-	return strings.Repeat(s, idSize/2)
-}
-
-func byteRepeat(b byte) []byte {
-	return bytes.Repeat([]byte{b}, idSize/2)
-}
-
 func TestIDFromString(t *testing.T) {
 	for _, c := range [...]struct {
 		in      string
-		want    []byte
+		want    ID
 		wantErr bool
 	}{
-		{"", nil, true},
-		{"invalidhex", nil, true},
-		{strings.Repeat("0", idSize-1), nil, true},
-		{strings.Repeat("0", idSize+1), nil, true},
-		{strRepeat("00"), byteRepeat(0x00), false},
-		{strRepeat("01"), byteRepeat(0x01), false},
-		{strRepeat("0a"), byteRepeat(0x0a), false},
-		{strRepeat("0F"), byteRepeat(0x0f), false},
-		{strRepeat("10"), byteRepeat(0x10), false},
-		{strRepeat("ee"), byteRepeat(0xee), false},
+		{"", "", true},
+		{"000", "", true},
+		{strings.Repeat("0", 65), "", true},
+		{"invalid/id", "", true},
+		{"invalid_id", "", true},
+		{"-abcd", "", true},
+		{"abcd-", "", true},
+		{"ab--cd", "", true},
+		{"0000", "0000", false},
+		{"0a0a0a0a", "0a0a0a0a", false},
+		{"0F0F0F0F", "0F0F0F0F", false},
+		{"aB3xY9kQ", "aB3xY9kQ", false},
+		{"brave-otter", "brave-otter", false},
+		{"~build-1234.log", "~build-1234.log", false},
+		{"~Build_1234", "~Build_1234", false},
+		{"~ab", "", true},
+		{"~.hidden", "", true},
+		{"~a/b/c", "", true},
+		{"~../../etc", "", true},
 	} {
 		got, err := IDFromString(c.in)
 		if c.wantErr {
@@ -39,29 +43,128 @@ func TestIDFromString(t *testing.T) {
 			}
 		} else if err != nil {
 			t.Errorf(`IDFromString("%s") errored unexpectedly`, c.in)
-		} else if !reflect.DeepEqual(got[:], c.want) {
-			t.Errorf(`IDFromString("%s") got %q, want %q`, c.in, got[:], c.want)
+		} else if got != c.want {
+			t.Errorf(`IDFromString("%s") got "%s", want "%s"`, c.in, got, c.want)
+		}
+	}
+}
+
+func TestIDFormat(t *testing.T) {
+	defer SetIDFormat(DefaultIDFormat)
+	for _, c := range []struct {
+		in      string
+		want    string
+		pattern string
+	}{
+		{"hex", "hex:8", "^[0-9a-f]{8}$"},
+		{"hex:16", "hex:16", "^[0-9a-f]{16}$"},
+		{"base62:12", "base62:12", "^[0-9A-Za-z]{12}$"},
+		{"base32", "base32:10", "^[0-9a-hjkmnp-tv-z]{10}$"},
+		{"words:3", "words:3", "^[a-z]+-[a-z]+-[a-z]+$"},
+		{"hex:3", "", ""},
+		{"hex:65", "", ""},
+		{"words:0", "", ""},
+		{"words:20", "", ""},
+		{"hex:x", "", ""},
+		{"base64", "", ""},
+	} {
+		var f IDFormat
+		err := f.Set(c.in)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf(`IDFormat.Set("%s") didn't error as expected`, c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(`IDFormat.Set("%s") errored unexpectedly: %v`, c.in, err)
+			continue
+		}
+		if got := f.String(); got != c.want {
+			t.Errorf(`IDFormat.Set("%s") got "%s", want "%s"`, c.in, got, c.want)
+		}
+		SetIDFormat(f)
+		id, err := randomID(func(ID) bool { return true })
+		if err != nil {
+			t.Errorf(`randomID() errored unexpectedly with "%s"`, c.in)
+			continue
+		}
+		if !regexp.MustCompile(c.pattern).MatchString(id.String()) {
+			t.Errorf(`randomID() with "%s" got "%s", want a match of %s`, c.in, id, c.pattern)
+		}
+		if got, err := IDFromString(id.String()); err != nil || got != id {
+			t.Errorf(`IDFromString("%s") got "%s", want the same`, id, got)
 		}
 	}
 }
 
-func TestIDString(t *testing.T) {
-	var id ID
+func TestPathFromID(t *testing.T) {
 	for _, c := range []struct {
-		in   []byte
+		id   ID
 		want string
 	}{
-		{byteRepeat(0x00), strRepeat("00")},
-		{byteRepeat(0xee), strRepeat("ee")},
+		{"a63d03b9", filepath.Join("a6", "3d03b9")},
+		{"aB3x", filepath.Join("a_", "b3x")},
+		{"Ab3x", filepath.Join("_a", "b3x")},
+		{"brave-otter", filepath.Join("br", "ave-otter")},
+		{"~build-1234.log", filepath.Join("~b", "uild-1234_2elog")},
+		{"~My_log..", filepath.Join("~_", "my_5flog_2e_2e")},
 	} {
-		copy(id[:], c.in)
-		got := id.String()
+		got := pathFromID(c.id)
 		if got != c.want {
-			t.Errorf(`ID.String() for %q got "%s", want "%s"`, c.in, got, c.want)
+			t.Errorf(`pathFromID("%s") got "%s", want "%s"`, c.id, got, c.want)
+		}
+		if id, err := idFromPath(got); err != nil || id != c.id {
+			t.Errorf(`idFromPath("%s") got "%s", want "%s"`, got, id, c.id)
+		}
+	}
+	for _, path := range []string{"a_/_b3x", "a_", "ab/c_", "ab/c_D", "~a/b_41", "~a/b_2"} {
+		if _, err := idFromPath(path); err == nil {
+			t.Errorf(`idFromPath("%s") didn't error as expected`, path)
 		}
 	}
 }
 
+func TestFileStoreIDFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastecat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetIDFormat(DefaultIDFormat)
+	var ids []ID
+	for i, format := range []string{"hex", "base62:16", "words"} {
+		var f IDFormat
+		if err := f.Set(format); err != nil {
+			t.Fatal(err)
+		}
+		SetIDFormat(f)
+		s, err := NewFileStore(&Stats{}, nil, 0, dir)
+		if err != nil {
+			t.Fatalf("Could not recover the pastes before using %s: %v", format, err)
+		}
+		for _, id := range ids {
+			p, err := s.Get(id)
+			if err != nil {
+				t.Errorf("Get(%s) errored unexpectedly with %s: %v", id, format, err)
+				continue
+			}
+			p.Close()
+		}
+		id, err := s.Put(strings.NewReader(format), Metadata{})
+		if err != nil {
+			t.Fatalf("Put errored unexpectedly with %s: %v", format, err)
+		}
+		ids = append(ids, id)
+		named, _ := NamedID(fmt.Sprintf("Named.%d", i))
+		if err := s.PutNamed(named, strings.NewReader(format), Metadata{}); err != nil {
+			t.Fatalf("PutNamed errored unexpectedly with %s: %v", format, err)
+		}
+		ids = append(ids, named)
+		s.Close()
+	}
+}
+
 func TestRandomID(t *testing.T) {
 	countFalse := func(count int) func(ID) bool {
 		cur := 0
@@ -92,3 +195,57 @@ func TestRandomID(t *testing.T) {
 		}
 	}
 }
+
+func TestPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("HashPassword() errored unexpectedly: %v", err)
+	}
+	if other, _ := HashPassword("secret"); other == hash {
+		t.Errorf("HashPassword() gave the same hash twice: %s", hash)
+	}
+	for _, c := range []struct {
+		meta     Metadata
+		password string
+		want     bool
+	}{
+		{Metadata{PasswordHash: hash}, "secret", true},
+		{Metadata{PasswordHash: hash}, "Secret", false},
+		{Metadata{PasswordHash: hash}, "", false},
+		{Metadata{PasswordHash: hash}, hash, false},
+		{Metadata{PasswordHash: "pbkdf2-sha256$1$00$"}, "secret", false},
+		{Metadata{PasswordHash: "sha256$1$00$00"}, "secret", false},
+		{Metadata{}, "secret", false},
+		{Metadata{}, "", false},
+	} {
+		got := c.meta.CheckPassword(c.password)
+		if got != c.want {
+			t.Errorf(`%+v.CheckPassword("%s") got %t, want %t`, c.meta, c.password, got, c.want)
+		}
+	}
+}
+
+func TestDeleteToken(t *testing.T) {
+	token, hash, err := NewDeleteToken()
+	if err != nil {
+		t.Fatalf("NewDeleteToken() errored unexpectedly: %v", err)
+	}
+	other, _, _ := NewDeleteToken()
+	for _, c := range []struct {
+		meta  Metadata
+		token string
+		want  bool
+	}{
+		{Metadata{DeleteHash: hash}, token, true},
+		{Metadata{DeleteHash: hash}, other, false},
+		{Metadata{DeleteHash: hash}, "", false},
+		{Metadata{DeleteHash: hash}, hash, false},
+		{Metadata{}, token, false},
+		{Metadata{}, "", false},
+	} {
+		got := c.meta.CheckDeleteToken(c.token)
+		if got != c.want {
+			t.Errorf(`%+v.CheckDeleteToken("%s") got %t, want %t`, c.meta, c.token, got, c.want)
+		}
+	}
+}
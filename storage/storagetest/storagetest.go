@@ -0,0 +1,440 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// Package storagetest implements a conformance test suite for
+// implementations of storage.Store.
+package storagetest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// How long to wait at most for an expired paste to be deleted
+const expiryTimeout = 5 * time.Second
+
+// Opener returns a store that uses the given stats and expirer. Persistent
+// stores must recover the pastes that were put in the stores previously
+// returned by the same Opener.
+type Opener func(stats *storage.Stats, expirer *storage.Expirer) (storage.Store, error)
+
+// NewOpener returns an Opener for stores in a new, empty location, such as
+// a new temporary directory.
+type NewOpener func(t *testing.T) Opener
+
+// TestStore runs the conformance test suite on the stores returned by the
+// Openers from newOpener, one per test. If persistent is set, pastes are
+// also expected to survive a restart.
+func TestStore(t *testing.T, newOpener NewOpener, persistent bool) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, open Opener)
+	}{
+		{"PutGet", testPutGet},
+		{"ReadAtSeek", testReadAtSeek},
+		{"Empty", testEmpty},
+		{"NotFound", testNotFound},
+		{"Delete", testDelete},
+		{"Update", testUpdate},
+		{"ReadDuringDelete", testReadDuringDelete},
+		{"ConcurrentReaders", testConcurrentReaders},
+		{"Stats", testStats},
+		{"Limits", testLimits},
+		{"Expiry", testExpiry},
+		{"Close", testClose},
+		{"Named", testNamed},
+	}
+	if persistent {
+		tests = append(tests, struct {
+			name string
+			fn   func(t *testing.T, open Opener)
+		}{"Recover", testRecover})
+	}
+	for _, test := range tests {
+		fn := test.fn
+		t.Run(test.name, func(t *testing.T) { fn(t, newOpener(t)) })
+	}
+}
+
+// env holds a store under test along with what it was opened with
+type env struct {
+	t     *testing.T
+	store storage.Store
+	stats *storage.Stats
+}
+
+func newEnv(t *testing.T, open Opener, stats *storage.Stats) *env {
+	s, err := open(stats, storage.NewExpirer())
+	if err != nil {
+		t.Fatalf("Could not open store: %v", err)
+	}
+	return &env{t: t, store: s, stats: stats}
+}
+
+func (e *env) put(content string, meta storage.Metadata) storage.ID {
+	id, err := e.store.Put(strings.NewReader(content), meta)
+	if err != nil {
+		e.t.Fatalf("Put errored unexpectedly: %v", err)
+	}
+	return id
+}
+
+func (e *env) get(id storage.ID) storage.Paste {
+	p, err := e.store.Get(id)
+	if err != nil {
+		e.t.Fatalf("Get(%s) errored unexpectedly: %v", id, err)
+	}
+	return p
+}
+
+// wantContent checks that the paste known by id holds the given content and
+// metadata.
+func (e *env) wantContent(id storage.ID, content string, meta storage.Metadata) {
+	p := e.get(id)
+	defer p.Close()
+	got, err := ioutil.ReadAll(p)
+	if err != nil {
+		e.t.Fatalf("Reading %s errored unexpectedly: %v", id, err)
+	}
+	if string(got) != content {
+		e.t.Errorf("Paste %s got content %q, want %q", id, got, content)
+	}
+	if p.Size() != int64(len(content)) {
+		e.t.Errorf("Paste %s got size %d, want %d", id, p.Size(), len(content))
+	}
+	gotMeta := p.Metadata()
+	if !gotMeta.Expires.Equal(meta.Expires) {
+		e.t.Errorf("Paste %s got expiry %s, want %s", id, gotMeta.Expires, meta.Expires)
+	}
+	gotMeta.Expires, meta.Expires = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(gotMeta, meta) {
+		e.t.Errorf("Paste %s got metadata %+v, want %+v", id, gotMeta, meta)
+	}
+}
+
+func (e *env) wantNotFound(id storage.ID) {
+	if _, err := e.store.Get(id); err != storage.ErrPasteNotFound {
+		e.t.Errorf("Get(%s) got error %v, want %v", id, err, storage.ErrPasteNotFound)
+	}
+}
+
+func (e *env) wantStats(number int, size int64) {
+	gotNumber, gotSize := e.stats.Report()
+	if gotNumber != number || gotSize != size {
+		e.t.Errorf("Stats got %d pastes using %d bytes, want %d using %d",
+			gotNumber, gotSize, number, size)
+	}
+}
+
+func testPutGet(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	before := time.Now().Add(-time.Second)
+	metas := []storage.Metadata{
+		{},
+		{
+			Expires:      time.Now().Add(time.Hour),
+			Burn:         true,
+			Filename:     "foo.txt",
+			DeleteHash:   "abcd",
+			PasswordHash: "pbkdf2-sha256$1$00$00",
+			ContentType:  "text/plain",
+			Uploader:     "127.0.0.1",
+			Header:       map[string]string{"X-Paste-Foo": "bar"},
+			Views:        3,
+		},
+	}
+	for i, meta := range metas {
+		content := strings.Repeat("content\n", i*1000+1)
+		id := e.put(content, meta)
+		e.wantContent(id, content, meta)
+		p := e.get(id)
+		if p.ModTime().Before(before) || p.ModTime().After(time.Now()) {
+			t.Errorf("Paste %s got unexpected modification time %s", id, p.ModTime())
+		}
+		p.Close()
+	}
+}
+
+func testReadAtSeek(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	id := e.put("0123456789", storage.Metadata{})
+	p := e.get(id)
+	defer p.Close()
+	buf := make([]byte, 3)
+	if n, err := p.ReadAt(buf, 4); err != nil || string(buf[:n]) != "456" {
+		t.Errorf("ReadAt(4) got %q and error %v", buf[:n], err)
+	}
+	if off, err := p.Seek(-2, io.SeekEnd); err != nil || off != 8 {
+		t.Errorf("Seek(-2, end) got offset %d and error %v", off, err)
+	}
+	if rest, err := ioutil.ReadAll(p); err != nil || string(rest) != "89" {
+		t.Errorf("Reading after Seek got %q and error %v", rest, err)
+	}
+}
+
+func testEmpty(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	if _, err := e.store.Put(strings.NewReader(""), storage.Metadata{}); err != storage.ErrEmptyPaste {
+		t.Errorf("Put of an empty paste got error %v, want %v", err, storage.ErrEmptyPaste)
+	}
+	e.wantStats(0, 0)
+}
+
+func testNotFound(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	id := e.put("content", storage.Metadata{})
+	other := id + "0"
+	e.wantNotFound(other)
+	if err := e.store.Update(other, func(*storage.Metadata) {}); err != storage.ErrPasteNotFound {
+		t.Errorf("Update(%s) got error %v, want %v", other, err, storage.ErrPasteNotFound)
+	}
+	if err := e.store.Delete(other); err != storage.ErrPasteNotFound {
+		t.Errorf("Delete(%s) got error %v, want %v", other, err, storage.ErrPasteNotFound)
+	}
+	e.wantStats(1, 7)
+}
+
+func testDelete(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	id := e.put("content", storage.Metadata{})
+	kept := e.put("kept", storage.Metadata{})
+	if err := e.store.Delete(id); err != nil {
+		t.Fatalf("Delete(%s) errored unexpectedly: %v", id, err)
+	}
+	e.wantNotFound(id)
+	if err := e.store.Delete(id); err != storage.ErrPasteNotFound {
+		t.Errorf("Second Delete(%s) got error %v, want %v", id, err, storage.ErrPasteNotFound)
+	}
+	e.wantContent(kept, "kept", storage.Metadata{})
+	e.wantStats(1, 4)
+}
+
+func testUpdate(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	meta := storage.Metadata{Filename: "foo.txt"}
+	id := e.put("content", meta)
+	p := e.get(id)
+	for i := 0; i < 3; i++ {
+		if err := e.store.Update(id, func(m *storage.Metadata) { m.Views++ }); err != nil {
+			t.Fatalf("Update(%s) errored unexpectedly: %v", id, err)
+		}
+	}
+	if got := p.Metadata(); !reflect.DeepEqual(got, meta) {
+		t.Errorf("Paste got before Update changed its metadata to %+v", got)
+	}
+	p.Close()
+	meta.Views = 3
+	e.wantContent(id, "content", meta)
+}
+
+func testNamed(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	n, ok := e.store.(storage.Namer)
+	if !ok {
+		t.Skip("store does not support names")
+	}
+	random := e.put("random", storage.Metadata{})
+	for _, name := range []string{"build-1234.log", "Build-1234.log", "a_b"} {
+		id, err := storage.NamedID(name)
+		if err != nil {
+			t.Fatalf("NamedID(%q) errored unexpectedly: %v", name, err)
+		}
+		if err := n.PutNamed(id, strings.NewReader(name), storage.Metadata{}); err != nil {
+			t.Fatalf("PutNamed(%s) errored unexpectedly: %v", id, err)
+		}
+		e.wantContent(id, name, storage.Metadata{})
+	}
+	id, _ := storage.NamedID("build-1234.log")
+	if err := n.PutNamed(id, strings.NewReader("other"), storage.Metadata{}); err != storage.ErrNameTaken {
+		t.Errorf("Second PutNamed(%s) got error %v, want %v", id, err, storage.ErrNameTaken)
+	}
+	e.wantContent(id, "build-1234.log", storage.Metadata{})
+	e.wantContent(random, "random", storage.Metadata{})
+	e.wantStats(4, 6+14+14+3)
+	if err := e.store.Delete(id); err != nil {
+		t.Fatalf("Delete(%s) errored unexpectedly: %v", id, err)
+	}
+	if err := n.PutNamed(id, strings.NewReader("again"), storage.Metadata{}); err != nil {
+		t.Fatalf("PutNamed(%s) after deleting it errored unexpectedly: %v", id, err)
+	}
+	e.wantContent(id, "again", storage.Metadata{})
+}
+
+func testReadDuringDelete(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	content := strings.Repeat("content\n", 1000)
+	id := e.put(content, storage.Metadata{})
+	p := e.get(id)
+	deleted := make(chan error)
+	go func() { deleted <- e.store.Delete(id) }()
+	got, err := ioutil.ReadAll(p)
+	if err != nil || string(got) != content {
+		t.Errorf("Reading while deleting got %d bytes and error %v", len(got), err)
+	}
+	p.Close()
+	if err := <-deleted; err != nil {
+		t.Errorf("Delete(%s) errored unexpectedly: %v", id, err)
+	}
+	e.wantNotFound(id)
+	e.wantStats(0, 0)
+}
+
+func testConcurrentReaders(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	content := strings.Repeat("content\n", 100)
+	id := e.put(content, storage.Metadata{})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := e.store.Get(id)
+			if err == storage.ErrPasteNotFound {
+				return
+			}
+			if err != nil {
+				t.Errorf("Get(%s) errored unexpectedly: %v", id, err)
+				return
+			}
+			defer p.Close()
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, p); err != nil || buf.String() != content {
+				t.Errorf("Concurrent read got %d bytes and error %v", buf.Len(), err)
+			}
+		}()
+	}
+	if err := e.store.Delete(id); err != nil {
+		t.Errorf("Delete(%s) errored unexpectedly: %v", id, err)
+	}
+	wg.Wait()
+	e.wantNotFound(id)
+	e.wantStats(0, 0)
+}
+
+func testStats(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	var ids []storage.ID
+	var total int64
+	for i := 1; i <= 5; i++ {
+		content := strings.Repeat("x", i*100)
+		ids = append(ids, e.put(content, storage.Metadata{}))
+		total += int64(len(content))
+		e.wantStats(i, total)
+	}
+	for i, id := range ids {
+		if err := e.store.Delete(id); err != nil {
+			t.Fatalf("Delete(%s) errored unexpectedly: %v", id, err)
+		}
+		total -= int64((i + 1) * 100)
+		e.wantStats(len(ids)-i-1, total)
+	}
+}
+
+func testLimits(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{MaxNumber: 2, MaxStorage: 10})
+	e.put("12345", storage.Metadata{})
+	if _, err := e.store.Put(strings.NewReader("123456"), storage.Metadata{}); err != storage.ErrReachedMaxStorage {
+		t.Errorf("Put over the storage limit got error %v, want %v", err, storage.ErrReachedMaxStorage)
+	}
+	e.wantStats(1, 5)
+	e.put("12345", storage.Metadata{})
+	if _, err := e.store.Put(strings.NewReader("1"), storage.Metadata{}); err != storage.ErrReachedMaxNumber {
+		t.Errorf("Put over the number limit got error %v, want %v", err, storage.ErrReachedMaxNumber)
+	}
+	e.wantStats(2, 10)
+}
+
+func testExpiry(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	id := e.put("content", storage.Metadata{Expires: time.Now().Add(50 * time.Millisecond)})
+	kept := e.put("kept", storage.Metadata{Expires: time.Now().Add(time.Hour)})
+	deadline := time.Now().Add(expiryTimeout)
+	for {
+		p, err := e.store.Get(id)
+		if err == storage.ErrPasteNotFound {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Get(%s) errored unexpectedly: %v", id, err)
+		}
+		p.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("Paste %s was not deleted after expiring", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	e.get(kept).Close()
+	e.wantStats(1, 4)
+}
+
+func testClose(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	id := e.put("content", storage.Metadata{})
+	p := e.get(id)
+	closed := make(chan error, 1)
+	go func() { closed <- e.store.Close() }()
+	// pastes being read must keep working until they are closed
+	time.Sleep(20 * time.Millisecond)
+	if got, err := ioutil.ReadAll(p); err != nil || string(got) != "content" {
+		t.Errorf("Reading while closing got %q and error %v", got, err)
+	}
+	p.Close()
+	if err := <-closed; err != nil {
+		t.Fatalf("Close errored unexpectedly: %v", err)
+	}
+	if _, err := e.store.Get(id); err != storage.ErrStoreClosed {
+		t.Errorf("Get after Close got error %v, want %v", err, storage.ErrStoreClosed)
+	}
+	if _, err := e.store.Put(strings.NewReader("new"), storage.Metadata{}); err != storage.ErrStoreClosed {
+		t.Errorf("Put after Close got error %v, want %v", err, storage.ErrStoreClosed)
+	}
+	if err := e.store.Update(id, func(*storage.Metadata) {}); err != storage.ErrStoreClosed {
+		t.Errorf("Update after Close got error %v, want %v", err, storage.ErrStoreClosed)
+	}
+	if err := e.store.Delete(id); err != storage.ErrStoreClosed {
+		t.Errorf("Delete after Close got error %v, want %v", err, storage.ErrStoreClosed)
+	}
+	if err := e.store.Close(); err != storage.ErrStoreClosed {
+		t.Errorf("Second Close got error %v, want %v", err, storage.ErrStoreClosed)
+	}
+	e.wantStats(1, 7)
+}
+
+func testRecover(t *testing.T, open Opener) {
+	e := newEnv(t, open, &storage.Stats{})
+	meta := storage.Metadata{
+		Expires:  time.Now().Add(time.Hour),
+		Filename: "foo.txt",
+		Header:   map[string]string{"X-Paste-Foo": "bar"},
+	}
+	id := e.put("content", meta)
+	forever := e.put("forever", storage.Metadata{})
+	deleted := e.put("deleted", storage.Metadata{})
+	if err := e.store.Delete(deleted); err != nil {
+		t.Fatalf("Delete(%s) errored unexpectedly: %v", deleted, err)
+	}
+	if err := e.store.Update(id, func(m *storage.Metadata) { m.Views++ }); err != nil {
+		t.Fatalf("Update(%s) errored unexpectedly: %v", id, err)
+	}
+	expired := e.put("expired", storage.Metadata{Expires: time.Now().Add(50 * time.Millisecond)})
+	if err := e.store.Close(); err != nil {
+		t.Fatalf("Close errored unexpectedly: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	r := newEnv(t, open, &storage.Stats{})
+	meta.Views = 1
+	r.wantContent(id, "content", meta)
+	r.wantContent(forever, "forever", storage.Metadata{})
+	r.wantNotFound(deleted)
+	r.wantNotFound(expired)
+	r.wantStats(2, 14)
+}
@@ -0,0 +1,138 @@
+package storagetest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "pastecat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func memStores(t *testing.T) Opener {
+	return func(stats *storage.Stats, expirer *storage.Expirer) (storage.Store, error) {
+		return storage.NewMemStore(stats, expirer)
+	}
+}
+
+func fileStores(t *testing.T) Opener {
+	dir := tempDir(t)
+	return func(stats *storage.Stats, expirer *storage.Expirer) (storage.Store, error) {
+		return storage.NewFileStore(stats, expirer, 24*time.Hour, dir)
+	}
+}
+
+func mmapStores(t *testing.T) Opener {
+	dir := tempDir(t)
+	return func(stats *storage.Stats, expirer *storage.Expirer) (storage.Store, error) {
+		return storage.NewMmapStore(stats, expirer, 24*time.Hour, dir)
+	}
+}
+
+// wrapper returns a store wrapping inner, with the given stats and expirer
+type wrapper func(inner storage.Lister, stats *storage.Stats, expirer *storage.Expirer) (storage.Store, error)
+
+// wrapped returns a NewOpener of stores made by wrap around the ones opened
+// via inner, which are given stats of their own and a nil expirer.
+func wrapped(inner NewOpener, wrap wrapper) NewOpener {
+	return func(t *testing.T) Opener {
+		open := inner(t)
+		return func(stats *storage.Stats, expirer *storage.Expirer) (storage.Store, error) {
+			s, err := open(&storage.Stats{}, nil)
+			if err != nil {
+				return nil, err
+			}
+			return wrap(s.(storage.Lister), stats, expirer)
+		}
+	}
+}
+
+func dedup(inner storage.Lister, stats *storage.Stats, expirer *storage.Expirer) (storage.Store, error) {
+	return storage.NewDedupStore(inner, stats, expirer)
+}
+
+func compress(inner storage.Lister, stats *storage.Stats, expirer *storage.Expirer) (storage.Store, error) {
+	return storage.NewCompressStore(inner, stats, expirer)
+}
+
+// encrypt returns a wrapper encrypting with a test key.
+func encrypt(t *testing.T) wrapper {
+	keys := storage.NewKeyring()
+	if err := keys.Add("test", make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	return func(inner storage.Lister, stats *storage.Stats, expirer *storage.Expirer) (storage.Store, error) {
+		return storage.NewEncryptStore(inner, keys, stats, expirer)
+	}
+}
+
+func TestMemStore(t *testing.T)          { TestStore(t, memStores, false) }
+func TestFileStore(t *testing.T)         { TestStore(t, fileStores, true) }
+func TestMmapStore(t *testing.T)         { TestStore(t, mmapStores, true) }
+func TestDedupMemStore(t *testing.T)     { TestStore(t, wrapped(memStores, dedup), false) }
+func TestDedupFileStore(t *testing.T)    { TestStore(t, wrapped(fileStores, dedup), true) }
+func TestCompressMemStore(t *testing.T)  { TestStore(t, wrapped(memStores, compress), false) }
+func TestCompressFileStore(t *testing.T) { TestStore(t, wrapped(fileStores, compress), true) }
+func TestEncryptFileStore(t *testing.T)  { TestStore(t, wrapped(fileStores, encrypt(t)), true) }
+func TestEncryptMmapStore(t *testing.T)  { TestStore(t, wrapped(mmapStores, encrypt(t)), true) }
+
+func TestFileStoresCoexist(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stores [2]*storage.FileStore
+	var ids [2]storage.ID
+	for i := range stores {
+		s, err := storage.NewFileStore(&storage.Stats{}, storage.NewExpirer(), 24*time.Hour, tempDir(t))
+		if err != nil {
+			t.Fatalf("NewFileStore errored unexpectedly: %v", err)
+		}
+		if ids[i], err = s.Put(strings.NewReader("content"), storage.Metadata{}); err != nil {
+			t.Fatalf("Put errored unexpectedly: %v", err)
+		}
+		stores[i] = s
+	}
+	for i, s := range stores {
+		p, err := s.Get(ids[i])
+		if err != nil {
+			t.Fatalf("Get errored unexpectedly: %v", err)
+		}
+		p.Close()
+		if _, err := s.Get(ids[1-i]); err != storage.ErrPasteNotFound {
+			t.Errorf("Store %d got error %v for a paste in the other store", i, err)
+		}
+	}
+	if got, _ := os.Getwd(); got != wd {
+		t.Errorf("Working directory changed from %s to %s", wd, got)
+	}
+}
+
+func TestFileStoresRemoveTempFiles(t *testing.T) {
+	dir := tempDir(t)
+	temp := filepath.Join(dir, ".tmp-123")
+	if err := ioutil.WriteFile(temp, []byte("trunc"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stats := &storage.Stats{}
+	if _, err := storage.NewFileStore(stats, storage.NewExpirer(), 24*time.Hour, dir); err != nil {
+		t.Fatalf("NewFileStore errored unexpectedly: %v", err)
+	}
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Errorf("Temporary file left by a previous run was not removed")
+	}
+	if number, _ := stats.Report(); number != 0 {
+		t.Errorf("Temporary file left by a previous run was recovered as a paste")
+	}
+}
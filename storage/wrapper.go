@@ -0,0 +1,168 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// wrapper holds what the stores wrapping another one have in common. The
+// wrapped store accounts for the bytes it actually keeps in its Stats,
+// while the wrapper accounts for the bytes of each paste as put in its own.
+// Deletions are scheduled in the Expirer of the wrapper, so the wrapped
+// store should be opened with a nil one.
+type wrapper struct {
+	sync.RWMutex
+	inner Lister
+	// size of each paste as put
+	sizes   map[ID]int64
+	stats   *Stats
+	expirer *Expirer
+	closed  bool
+	// the store embedding the wrapper, which deletions are scheduled in
+	outer Store
+
+	// content returns the ID of the paste in inner that the content of
+	// the paste known by id is read from, and whether it is deleted along
+	// with it. If nil, it is the paste with the same ID.
+	content func(id ID) (ID, bool)
+	// deleted is called with the lock held once the paste known by id
+	// has been deleted from inner, if not nil.
+	deleted func(id ID)
+}
+
+// init sets up the wrapper of inner, to be embedded in outer.
+func (w *wrapper) init(outer Store, inner Lister, stats *Stats, expirer *Expirer) {
+	w.outer = outer
+	w.inner = inner
+	w.sizes = make(map[ID]int64)
+	w.stats = stats
+	w.expirer = expirer
+}
+
+// recovered accounts for a paste found in inner when opening the store,
+// scheduling its deletion.
+func (w *wrapper) recovered(id ID, size int64, expires time.Time) error {
+	if err := w.stats.MakeSpaceFor(size); err != nil {
+		return err
+	}
+	w.sizes[id] = size
+	w.expirer.Add(w.outer, id, expires)
+	return nil
+}
+
+// put puts a new paste under id, or under a random ID if it is empty. Its
+// content is read from r via putInner, which puts it in inner as kept and
+// returns the ID given to it. The bytes read are accounted for as they go,
+// and keep is called with the lock held once it has been put, if not nil.
+func (w *wrapper) put(id ID, r io.Reader, meta Metadata, putInner func(id ID, r io.Reader) (ID, error), keep func(id ID)) (ID, error) {
+	if err := w.stats.MakeSpaceFor(0); err != nil {
+		return "", err
+	}
+	sw := &statsWriter{w: ioutil.Discard, stats: w.stats}
+	id, err := putInner(id, io.TeeReader(r, sw))
+	if err != nil {
+		w.stats.FreeSpace(sw.n)
+		return "", err
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		w.stats.FreeSpace(sw.n)
+		return "", ErrStoreClosed
+	}
+	w.sizes[id] = sw.n
+	if keep != nil {
+		keep(id)
+	}
+	w.expirer.Add(w.outer, id, meta.Expires)
+	return id, nil
+}
+
+func (w *wrapper) Delete(id ID) error {
+	return w.delete(id, false)
+}
+
+func (w *wrapper) deleteUnlessBusy(id ID) error {
+	return w.delete(id, true)
+}
+
+func (w *wrapper) busy(id ID) bool {
+	w.RLock()
+	defer w.RUnlock()
+	_, e := w.sizes[id]
+	return e && w.contentBusy(id)
+}
+
+// contentBusy reports whether deleting the paste known by id would have to
+// wait for the readers of its content.
+func (w *wrapper) contentBusy(id ID) bool {
+	content, deleted := id, true
+	if w.content != nil {
+		content, deleted = w.content(id)
+	}
+	return deleted && busyIn(w.inner, content)
+}
+
+func (w *wrapper) delete(id ID, unlessBusy bool) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return ErrStoreClosed
+	}
+	size, e := w.sizes[id]
+	if !e {
+		return ErrPasteNotFound
+	}
+	if unlessBusy && w.contentBusy(id) {
+		return errPasteBusy
+	}
+	if err := w.inner.Delete(id); err != nil {
+		return err
+	}
+	if w.deleted != nil {
+		w.deleted(id)
+	}
+	delete(w.sizes, id)
+	w.stats.FreeSpace(size)
+	w.expirer.Remove(w.outer, id)
+	return nil
+}
+
+func (w *wrapper) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return ErrStoreClosed
+	}
+	w.closed = true
+	for id := range w.sizes {
+		w.expirer.Remove(w.outer, id)
+	}
+	return w.inner.Close()
+}
+
+func (w *wrapper) List() ([]ID, error) {
+	w.RLock()
+	defer w.RUnlock()
+	if w.closed {
+		return nil, ErrStoreClosed
+	}
+	ids := make([]ID, 0, len(w.sizes))
+	for id := range w.sizes {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Victim picks the paste to delete first via the wrapped store, if it can.
+func (w *wrapper) Victim(policy EvictPolicy) (ID, error) {
+	if ev, ok := w.inner.(Evictable); ok {
+		return ev.Victim(policy)
+	}
+	return "", ErrPasteNotFound
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Check whether the certificate files changed how often
+	certCheckInterval = 10 * time.Second
+
+	// HTTP response strings
+	clientCertRequired = "a valid client certificate is required to upload"
+)
+
+var errClientCertRequired = errors.New(clientCertRequired)
+
+// certReloader holds a TLS certificate, loading it again from its files
+// when they change or when SIGHUP is received. Connections that are
+// already open keep using the certificate they were set up with.
+type certReloader struct {
+	sync.RWMutex
+	certFile, keyFile string
+	cert              *tls.Certificate
+	modTimes          [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go cr.run(hup, time.NewTicker(certCheckInterval).C)
+	return cr, nil
+}
+
+func (cr *certReloader) fileModTimes() ([2]time.Time, error) {
+	var times [2]time.Time
+	for i, name := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return times, err
+		}
+		times[i] = fi.ModTime()
+	}
+	return times, nil
+}
+
+func (cr *certReloader) load() error {
+	times, err := cr.fileModTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.Lock()
+	cr.cert = &cert
+	cr.modTimes = times
+	cr.Unlock()
+	return nil
+}
+
+// changed reports whether the certificate files changed since they were
+// last loaded.
+func (cr *certReloader) changed() bool {
+	times, err := cr.fileModTimes()
+	if err != nil {
+		return false
+	}
+	cr.RLock()
+	defer cr.RUnlock()
+	return times != cr.modTimes
+}
+
+// run loads the certificate again when receiving from hup, or when the
+// files changed when receiving from check.
+func (cr *certReloader) run(hup <-chan os.Signal, check <-chan time.Time) {
+	for {
+		select {
+		case <-hup:
+		case <-check:
+			if !cr.changed() {
+				continue
+			}
+		}
+		if err := cr.load(); err != nil {
+			log.Printf("Could not reload the TLS certificate, keeping the old one: %v", err)
+			continue
+		}
+		log.Printf("Reloaded the TLS certificate from %s", cr.certFile)
+	}
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.RLock()
+	defer cr.RUnlock()
+	return cr.cert, nil
+}
+
+// setupTLS returns the TLS configuration to serve with given the
+// certificate and key files, and the file of the CAs to verify client
+// certificates with, if any.
+func setupTLS(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{GetCertificate: cr.getCertificate}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		// only uploads require them, so they are checked per request
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// hasClientCert reports whether r was sent with a verified client
+// certificate.
+func hasClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// redirectHTTPS redirects to the same URL over HTTPS, on the port that is
+// being listened to.
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(conf().listen); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	url := "https://" + host + r.URL.RequestURI()
+	http.Redirect(w, r, url, http.StatusMovedPermanently)
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate along with its key, as generated for tests
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	tls  tls.Certificate
+}
+
+// newTestCert returns a new certificate with the given common name, signed
+// by parent or by itself if parent is nil.
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, crypto.Signer(key)
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, key.Public(), signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert: cert,
+		key:  key,
+		tls:  tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+	}
+}
+
+// write writes the certificate and its key in PEM to the given files.
+func (tc *testCert) write(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(tc.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setModTime sets the modification time of the given files.
+func setModTime(t *testing.T, modTime time.Time, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serveTLS serves h over HTTPS with the given configuration, returning the
+// URL of the server.
+func serveTLS(t *testing.T, h http.Handler, config *tls.Config) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: h, TLSConfig: config}
+	go server.ServeTLS(ln, "", "")
+	t.Cleanup(func() { server.Close() })
+	return "https://" + ln.Addr().String()
+}
+
+// tlsClient returns a client that trusts any server certificate, sending
+// the given client certificate if any, and which opens a new connection
+// for each request.
+func tlsClient(cert *testCert) *http.Client {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{cert.tls}
+	}
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   config,
+		DisableKeepAlives: true,
+	}}
+}
+
+// servedName returns the common name of the certificate served at u.
+func servedName(t *testing.T, u string) string {
+	t.Helper()
+	resp, err := tlsClient(nil).Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	newTestCert(t, "first", false, nil).write(t, certFile, keyFile)
+	start := time.Now().Add(-time.Hour)
+	setModTime(t, start, certFile, keyFile)
+
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		t.Fatalf("load errored unexpectedly: %v", err)
+	}
+	hup := make(chan os.Signal)
+	check := make(chan time.Time)
+	go cr.run(hup, check)
+	// run only receives again once it is done with the last one
+	wait := func() { check <- time.Now() }
+	u := serveTLS(t, http.NotFoundHandler(), &tls.Config{GetCertificate: cr.getCertificate})
+	if got := servedName(t, u); got != "first" {
+		t.Fatalf("Served certificate %s, want first", got)
+	}
+
+	// the files changing
+	newTestCert(t, "second", false, nil).write(t, certFile, keyFile)
+	setModTime(t, start.Add(time.Minute), certFile, keyFile)
+	check <- time.Now()
+	wait()
+	if got := servedName(t, u); got != "second" {
+		t.Errorf("Served certificate %s after the files changed, want second", got)
+	}
+
+	// the files changing without their times doing so, which is only
+	// noticed on SIGHUP
+	newTestCert(t, "third", false, nil).write(t, certFile, keyFile)
+	setModTime(t, start.Add(time.Minute), certFile, keyFile)
+	check <- time.Now()
+	wait()
+	if got := servedName(t, u); got != "second" {
+		t.Errorf("Served certificate %s with the files unchanged, want second", got)
+	}
+	hup <- os.Interrupt
+	wait()
+	if got := servedName(t, u); got != "third" {
+		t.Errorf("Served certificate %s after SIGHUP, want third", got)
+	}
+
+	// broken files keep the last certificate
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hup <- os.Interrupt
+	wait()
+	if got := servedName(t, u); got != "third" {
+		t.Errorf("Served certificate %s after breaking the files, want third", got)
+	}
+}
+
+func TestClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	newTestCert(t, "server", false, nil).write(t, certFile, keyFile)
+	ca := newTestCert(t, "ca", true, nil)
+	ca.write(t, caFile, filepath.Join(dir, "ca.key"))
+	client := newTestCert(t, "client", false, ca)
+	stranger := newTestCert(t, "stranger", false, nil)
+
+	h := newTestHandler(t, "-c", certFile, "-k", keyFile, "-C", caFile)
+	config, err := setupTLS(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("setupTLS errored unexpectedly: %v", err)
+	}
+	u := serveTLS(t, h, config)
+	do := func(cert *testCert, method, target string) (int, string) {
+		t.Helper()
+		var resp *http.Response
+		var err error
+		if method == "POST" {
+			resp, err = tlsClient(cert).PostForm(u+target, url.Values{fieldName: {"foo"}})
+		} else {
+			resp, err = tlsClient(cert).Get(u + target)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if status, _ := do(nil, "POST", "/"); status != http.StatusForbidden {
+		t.Errorf("Upload without a client certificate got %d, want %d", status, http.StatusForbidden)
+	}
+	// not even sent, as the server asks for the ones from its CAs
+	if status, _ := do(stranger, "POST", "/"); status != http.StatusForbidden {
+		t.Errorf("Upload with a client certificate from another CA got %d, want %d",
+			status, http.StatusForbidden)
+	}
+	status, body := do(client, "POST", "/")
+	if status != http.StatusOK {
+		t.Fatalf("Upload with a client certificate got %d, want %d", status, http.StatusOK)
+	}
+	id := path.Base(strings.TrimSpace(body))
+	if status, body := do(nil, "GET", "/"+id); status != http.StatusOK || body != "foo" {
+		t.Errorf("GET without a client certificate got %d and %q", status, body)
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	for _, c := range []struct {
+		listen, target, want string
+	}{
+		{":443", "http://my.site/a63d03b9", "https://my.site/a63d03b9"},
+		{":443", "http://my.site:80/a63d03b9?password=x", "https://my.site/a63d03b9?password=x"},
+		{":8443", "http://my.site/", "https://my.site:8443/"},
+		{"127.0.0.1:8443", "http://[::1]:8080/~build.log", "https://[::1]:8443/~build.log"},
+	} {
+		setConf(t, "-l", c.listen)
+		w := httptest.NewRecorder()
+		redirectHTTPS(w, httptest.NewRequest("GET", c.target, nil))
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("Redirect from %s got %d, want %d", c.target, w.Code, http.StatusMovedPermanently)
+		}
+		if got := w.Header().Get("Location"); got != c.want {
+			t.Errorf("Redirect from %s with -l %s got %s, want %s", c.target, c.listen, got, c.want)
+		}
+		if !strings.HasPrefix(w.Body.String(), "<a href") {
+			t.Errorf("Redirect from %s got body %q", c.target, w.Body)
+		}
+	}
+}
@@ -3,25 +3,68 @@
 
 package main
 
-import "html/template"
+import (
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
 
-var tmpl *template.Template
+// Templates in use, swapped when reloading them
+var tmpl atomic.Pointer[template.Template]
 
-func loadTemplates() {
-	for name, s := range templates {
-		var t *template.Template
-		if tmpl == nil {
-			tmpl = template.New(name)
-		}
-		if name == tmpl.Name() {
-			t = tmpl
-		} else {
-			t = tmpl.New(name)
-		}
-		if _, err := t.Parse(s); err != nil {
-			panic("could not load templates")
+// loadTemplates parses the builtin templates, replacing the ones that have
+// a file of their own in dir, if given.
+func loadTemplates(dir string) (*template.Template, error) {
+	t := template.New("")
+	for _, m := range []map[string]string{templates, partials} {
+		for name, s := range m {
+			if dir != "" {
+				b, err := ioutil.ReadFile(filepath.Join(dir, templateFile(name)))
+				if err == nil {
+					s = string(b)
+				} else if !os.IsNotExist(err) {
+					return nil, err
+				}
+			}
+			if _, err := t.New(name).Parse(s); err != nil {
+				return nil, err
+			}
 		}
 	}
+	return t, nil
+}
+
+// templateFile returns the name of the file that replaces the template
+// known by name, such as "index.html" for "/" or "form.html" for "/form".
+func templateFile(name string) string {
+	if name == "/" {
+		return "index.html"
+	}
+	return strings.TrimPrefix(name, "/") + ".html"
+}
+
+// Iterations of PBKDF2 used to derive the key and IV of encrypted pastes
+// from their password, as given to "openssl enc -pbkdf2 -iter"
+const secretIterations = 100000
+
+// Custom header kept along with encrypted pastes, holding their HMAC-SHA256
+// keyed with their password, as given by "openssl dgst -hmac"
+const secretMACHeader = customHeaderPrefix + "HMAC"
+
+// Templates not served by themselves, to be used by the others
+var partials = map[string]string{
+	"options": `<select name="{{.ExpireName}}">
+			<option value="">Default lifetime</option>
+			<option value="10m">10 minutes</option>
+			<option value="1h">1 hour</option>
+			<option value="24h">1 day</option>
+			<option value="168h">1 week</option>
+			<option value="{{.ExpireNever}}">Never</option>
+		</select>
+		<label><input type="checkbox" name="{{.BurnName}}" value="true"/> Delete once read</label>`,
 }
 
 var templates = map[string]string{
@@ -42,11 +85,56 @@ Fetch it:
     $ curl {{.SiteURL}}/a63d03b9
     foo
 
-You can also use the <a href="form">web form</a>.
+Or upload a file as is:
+
+    $ curl -T file.txt {{.SiteURL}}
+
+Pick a shorter lifetime for it:
+
+    $ echo foo | curl -F {{.ExpireName}}=1h -F "{{.FieldName}}=&lt;-" {{.SiteURL}}
+
+Or have it deleted once it has been read:
+
+    $ echo foo | curl -F {{.BurnName}}=true -F "{{.FieldName}}=&lt;-" {{.SiteURL}}
+
+Or require a password to read it, given via HTTP Basic authentication:
+
+    $ echo foo | curl -F {{.PasswordName}}=secret -F "{{.FieldName}}=&lt;-" {{.SiteURL}}
+    $ curl -u :secret {{.SiteURL}}/a63d03b9
+
+Or give it a name of your own, if nobody has taken it yet:
+
+    $ echo foo | curl -F {{.VanityName}}=build-1234.log -F "{{.FieldName}}=&lt;-" {{.SiteURL}}
+    {{.SiteURL}}/~build-1234.log
+
+Each upload replies with a {{.TokenName}} header to delete the paste with:
+
+    $ curl -X DELETE -H "{{.TokenName}}: 9f86d081884c7d659a2feaa0c55ad015" {{.SiteURL}}/a63d03b9
+
+To keep the content from the server, encrypt it first and keep the key:
+
+    $ key=$(openssl rand -hex 16)
+    $ echo foo | openssl enc -aes-256-cbc -pbkdf2 -iter {{.Iterations}} -a -pass pass:$key &gt;foo.enc
+    $ mac=$(openssl dgst -sha256 -hmac $key -r foo.enc | cut -d" " -f1)
+    $ curl -H "{{.MACHeader}}: $mac" -F {{.EncryptedName}}=true -F "{{.FieldName}}=@foo.enc" {{.SiteURL}}
+    {{.SiteURL}}/a63d03b9
+
+Check that it wasn't modified before decrypting it:
+
+    $ curl -s {{.SiteURL}}/a63d03b9 &gt;foo.enc
+    $ openssl dgst -sha256 -hmac $key -r foo.enc | grep -q ^$mac &amp;&amp;
+        openssl enc -d -aes-256-cbc -pbkdf2 -iter {{.Iterations}} -a -pass pass:$key -in foo.enc
+    foo
+
+Links like {{.SiteURL}}/secret?a63d03b9#$key decrypt it in the browser.
+
+There is also a JSON API under {{.SiteURL}}/api/v1/pastes, and the
+<a href="form">web form</a>, along with <a href="secret">one encrypting in
+the browser</a>.
 {{if gt .MaxSize 0.0}}
 The maximum size per paste is {{.MaxSize}}.
 {{end}}{{if gt .LifeTime 0}}
-Each paste will be deleted after {{.LifeTime}}.
+Each paste will be deleted after {{.LifeTime}} at most.
 {{end}}
 <a href="http://github.com/mvdan/pastecat">github.com/mvdan/pastecat</a>
 </pre>
@@ -57,17 +145,176 @@ Each paste will be deleted after {{.LifeTime}}.
 <body style="text-align:center">
 <div style="inline-block">
 	<form action="{{.SiteURL}}/redirect" method="post" enctype="multipart/form-data">
+		{{template "options" .}}
+		<input type="password" name="{{.PasswordName}}" placeholder="Password, if any"></input>
+		<input type="text" name="{{.VanityName}}" placeholder="Name, if any"></input>
+		<br/>
 		<textarea cols=80 rows=24 name="{{.FieldName}}"></textarea>
 		<br/>
 		<button type="submit">Paste text</button>
 	</form>
 	<br/>
 	<form action="{{.SiteURL}}/redirect" method="post" enctype="multipart/form-data">
+		{{template "options" .}}
+		<input type="password" name="{{.PasswordName}}" placeholder="Password, if any"></input>
+		<input type="text" name="{{.VanityName}}" placeholder="Name, if any"></input>
 		<input type="file" name="{{.FieldName}}"></input>
 		<button type="submit">Paste file</button>
 	</form>
+	<br/>
+	<form action="{{.SiteURL}}/delete" method="post">
+		<input type="text" name="{{.IDName}}" placeholder="Paste id or url"></input>
+		<input type="text" name="{{.TokenName}}" placeholder="Delete token"></input>
+		<button type="submit">Delete paste</button>
+	</form>
 </div>
 </body>
 </html>
+`,
+	"/secret": `<html>
+<body style="text-align:center">
+<div style="display:inline-block;text-align:left">
+	<noscript>This page needs JavaScript to encrypt and decrypt pastes.</noscript>
+	<form id="upload">
+		{{template "options" .}}
+		<br/>
+		<textarea cols=80 rows=24 id="content"></textarea>
+		<br/>
+		<button type="submit">Encrypt and paste text</button>
+	</form>
+	<pre id="result"></pre>
+</div>
+<script>
+// Pastes are kept as "openssl enc -aes-256-cbc -pbkdf2 -a" would encrypt
+// them, with the password only given in the fragment of the link. As that
+// has no integrity protection, an HMAC-SHA256 of the paste keyed with the
+// password is kept in a header along with it, as "openssl dgst -hmac" would
+// compute it.
+var siteURL = {{.SiteURL}};
+var iterations = {{.Iterations}};
+var macHeader = {{.MACHeader}};
+var encoder = new TextEncoder();
+var magic = "Salted__";
+
+function show(text) {
+	document.getElementById("result").textContent = text;
+}
+
+function toBinary(bytes) {
+	var s = "";
+	for (var i = 0; i < bytes.length; i++) {
+		s += String.fromCharCode(bytes[i]);
+	}
+	return s;
+}
+
+function fromBinary(s) {
+	return Uint8Array.from(s, function(c) { return c.charCodeAt(0); });
+}
+
+function toHex(bytes) {
+	return Array.from(bytes, function(b) {
+		return ("0" + b.toString(16)).slice(-2);
+	}).join("");
+}
+
+// hmac returns the HMAC-SHA256 of text keyed with the password, in hex.
+async function hmac(text, pass) {
+	var key = await crypto.subtle.importKey("raw", encoder.encode(pass),
+		{name: "HMAC", hash: "SHA-256"}, false, ["sign"]);
+	var sum = await crypto.subtle.sign("HMAC", key, encoder.encode(text));
+	return toHex(new Uint8Array(sum));
+}
+
+// derive returns the key and IV for the given password and salt.
+async function derive(pass, salt, usage) {
+	var base = await crypto.subtle.importKey("raw", encoder.encode(pass),
+		"PBKDF2", false, ["deriveBits"]);
+	var bits = new Uint8Array(await crypto.subtle.deriveBits({name: "PBKDF2",
+		hash: "SHA-256", salt: salt, iterations: iterations}, base, 384));
+	var key = await crypto.subtle.importKey("raw", bits.slice(0, 32),
+		"AES-CBC", false, [usage]);
+	return {key: key, iv: bits.slice(32)};
+}
+
+async function encrypt(text, pass) {
+	var salt = crypto.getRandomValues(new Uint8Array(8));
+	var k = await derive(pass, salt, "encrypt");
+	var sealed = await crypto.subtle.encrypt({name: "AES-CBC", iv: k.iv},
+		k.key, encoder.encode(text));
+	var b64 = btoa(magic + toBinary(salt) + toBinary(new Uint8Array(sealed)));
+	return b64.replace(/.{64}/g, "$&\n").replace(/\n?$/, "\n");
+}
+
+async function decrypt(b64, pass) {
+	var bin = atob(b64.replace(/\s/g, ""));
+	if (bin.slice(0, 8) !== magic) {
+		throw new Error("not an encrypted paste");
+	}
+	var k = await derive(pass, fromBinary(bin.slice(8, 16)), "decrypt");
+	var opened = await crypto.subtle.decrypt({name: "AES-CBC", iv: k.iv},
+		k.key, fromBinary(bin.slice(16)));
+	return new TextDecoder().decode(opened);
+}
+
+var form = document.getElementById("upload");
+form.onsubmit = async function(e) {
+	e.preventDefault();
+	var pass = toHex(crypto.getRandomValues(new Uint8Array(16)));
+	var data = new FormData();
+	data.append({{.ExpireName}}, form.elements[{{.ExpireName}}].value);
+	if (form.elements[{{.BurnName}}].checked) {
+		data.append({{.BurnName}}, "true");
+	}
+	data.append({{.EncryptedName}}, "true");
+	var content = document.getElementById("content").value;
+	var sealed = await encrypt(content, pass);
+	data.append({{.FieldName}}, sealed);
+	var header = {};
+	header[macHeader] = await hmac(sealed, pass);
+	try {
+		var resp = await fetch(siteURL + "/api/v1/pastes",
+			{method: "POST", headers: header, body: data});
+		var info = await resp.json();
+	} catch (err) {
+		show("Could not upload the paste: " + err.message);
+		return;
+	}
+	if (!resp.ok) {
+		show("Could not upload the paste: " + info.error);
+		return;
+	}
+	form.style.display = "none";
+	show("Share this link, which holds the key to decrypt the paste:\n\n" +
+		siteURL + "/secret?" + info.id + "#" + pass + "\n\n" +
+		"Delete it with the token " + info.delete_token);
+};
+
+if (location.search && location.hash) {
+	form.style.display = "none";
+	var id = location.search.slice(1), pass = location.hash.slice(1);
+	fetch(siteURL + "/" + encodeURIComponent(id)).then(function(resp) {
+		return resp.text().then(function(text) {
+			if (!resp.ok) {
+				throw new Error(text.trim());
+			}
+			var mac = resp.headers.get(macHeader);
+			if (!mac) {
+				throw new Error("it has no HMAC to verify it with");
+			}
+			return hmac(text, pass).then(function(sum) {
+				if (sum !== mac.toLowerCase()) {
+					throw new Error("its HMAC does not match, it was modified");
+				}
+				return decrypt(text, pass);
+			});
+		});
+	}).then(show, function(err) {
+		show("Could not decrypt the paste: " + err.message);
+	});
+}
+</script>
+</body>
+</html>
 `,
 }
@@ -0,0 +1,86 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// viewCounter counts the views of pastes in memory, so that serving a paste
+// doesn't have to write to the store each time. The counts are added to the
+// metadata of the pastes in batches.
+type viewCounter struct {
+	sync.Mutex
+	pending map[storage.ID]int64
+
+	// closed to stop writing the counts, and once the last ones are written
+	stopping, stopped chan struct{}
+}
+
+func newViewCounter() *viewCounter {
+	return &viewCounter{pending: make(map[storage.ID]int64)}
+}
+
+// count records a view of the paste with the given ID.
+func (v *viewCounter) count(id storage.ID) {
+	v.Lock()
+	defer v.Unlock()
+	v.pending[id]++
+}
+
+// get returns the views of the paste with the given ID that are yet to be
+// written to the store.
+func (v *viewCounter) get(id storage.ID) int64 {
+	v.Lock()
+	defer v.Unlock()
+	return v.pending[id]
+}
+
+// flush adds the views counted so far to the metadata of their pastes in
+// store. Pastes that were deleted in the meantime are skipped.
+func (v *viewCounter) flush(store storage.Store, m *metrics) {
+	v.Lock()
+	pending := v.pending
+	v.pending = make(map[storage.ID]int64)
+	v.Unlock()
+	for id, n := range pending {
+		err := store.Update(id, func(meta *storage.Metadata) { meta.Views += n })
+		if err != nil && err != storage.ErrPasteNotFound {
+			log.Printf("Could not count views of %s: %v", id, err)
+			m.storeError("update")
+		}
+	}
+}
+
+// start writes the views counted to store every interval, until stop is
+// called.
+func (v *viewCounter) start(store storage.Store, m *metrics, interval time.Duration) {
+	v.stopping = make(chan struct{})
+	v.stopped = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				v.flush(store, m)
+			case <-v.stopping:
+				v.flush(store, m)
+				close(v.stopped)
+				return
+			}
+		}
+	}()
+}
+
+// stop stops writing the views counted every interval, once the ones
+// counted so far are written.
+func (v *viewCounter) stop() {
+	close(v.stopping)
+	<-v.stopped
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+func TestViewCounterStop(t *testing.T) {
+	h := newTestHandler(t)
+	id, _ := mustUpload(t, h, "foo")
+	h.views.start(h.store, h.metrics, time.Hour)
+	wantResponse(t, serve(h, "GET", "/"+id, nil), "GET", http.StatusOK, "foo")
+	h.views.stop()
+	if n := h.views.get(storage.ID(id)); n != 0 {
+		t.Errorf("Stopping left %d views to be written", n)
+	}
+	p, err := h.store.Get(storage.ID(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if got := p.Metadata().Views; got != 1 {
+		t.Errorf("Stopping wrote %d views, want 1", got)
+	}
+}